@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first descriptor passed by systemd-style socket activation (after stdin/out/err)
+const listenFDsStart = 3
+
+// ActivatedListener returns a listener handed to us by our parent, either through systemd-style
+// LISTEN_FDS/LISTEN_PID or an explicit inherited fd (fd < 0 means none), nil if neither was given
+func ActivatedListener(fd int) (*net.UDPConn, error) {
+
+	// Socket Activation: systemd sets LISTEN_PID to *our* pid, so a grand-child won't grab them by accident
+	if count := os.Getenv("LISTEN_FDS"); count != "" {
+		if pid := os.Getenv("LISTEN_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+
+			num, err := strconv.Atoi(count)
+			if err != nil {
+				return nil, fmt.Errorf("ActivatedListener(): LISTEN_FDS:[%s] is not a number", count)
+			}
+
+			// Don't pass these on to anything we exec
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDNAMES")
+
+			for i := 0; i < num; i++ {
+				conn, err := InheritedListener(listenFDsStart + i)
+				if err == nil {
+					return conn, nil
+				}
+				logger.Error("listener: skipping inherited fd", "fd", listenFDsStart+i, "err", err)
+			}
+			return nil, fmt.Errorf("ActivatedListener(): none of the LISTEN_FDS:[%d] are UDP sockets", num)
+		}
+	}
+
+	if fd >= 0 {
+		return InheritedListener(fd)
+	}
+
+	return nil, nil
+}
+
+// InheritedListener wraps an already bound UDP socket, given as an open file descriptor
+func InheritedListener(fd int) (*net.UDPConn, error) {
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("listener-fd-%d", fd))
+	if file == nil {
+		return nil, fmt.Errorf("InheritedListener(): invalid fd:[%d]", fd)
+	}
+	// NOTE: FilePacketConn dups the descriptor, so ours is closed either way
+	defer file.Close()
+
+	pc, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("InheritedListener(): fd:[%d] err.Error():[%s]", fd, err.Error())
+	}
+
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("InheritedListener(): fd:[%d] is not a UDP socket", fd)
+	}
+
+	logger.Info("listener: inherited", "addr", conn.LocalAddr().String(), "fd", fd)
+
+	return conn, nil
+}
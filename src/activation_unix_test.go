@@ -0,0 +1,57 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// dupFd hands out a copy of the file's descriptor, as InheritedListener takes ownership of what it's given
+func dupFd(t *testing.T, fd uintptr) int {
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dup
+}
+
+func TestInheritedListener(t *testing.T) {
+	orig, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	file, err := orig.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	conn, err := InheritedListener(dupFd(t, file.Fd()))
+	if err != nil {
+		t.Fatalf("InheritedListener(): %s", err)
+	}
+	defer conn.Close()
+
+	if conn.LocalAddr().String() != orig.LocalAddr().String() {
+		t.Errorf("Inherited listener: expected %s; got %s", orig.LocalAddr(), conn.LocalAddr())
+	}
+
+	// Not a UDP socket
+	tcp, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	tcpFile, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+	if _, err := InheritedListener(dupFd(t, tcpFile.Fd())); err == nil {
+		t.Errorf("InheritedListener() on TCP socket: expected error")
+	}
+}
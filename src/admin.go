@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// paused is set by the admin API to refuse new requests, transfers in progress carry on
+var paused atomic.Bool
+
+// Paused determines if new requests are being refused
+func Paused() bool {
+	return paused.Load()
+}
+
+// AdminStatus is the response for GET /status
+type AdminStatus struct {
+	Paused          bool `json:"paused"`
+	ActiveTransfers int  `json:"active_transfers"`
+	CacheEntries    int  `json:"cache_entries"`
+	CacheBytes      int  `json:"cache_bytes"`
+}
+
+// NewAdminHandler creates the admin API:
+//
+//	GET    /status                     paused flag, active transfers, cache usage
+//	GET    /transfers                  active transfers with progress
+//	POST   /transfers/{id}/abort       abort a transfer, the client is sent ERROR (DELETE /transfers/{id} too)
+//	GET    /cache                      files held in the FileNexus
+//	DELETE /cache?name={name}          evict a file from the FileNexus
+//	POST   /pause, POST /resume        stop/start accepting new requests
+//	GET    /ratelimit                  rate limits (bytes/sec) in force
+//	PUT    /ratelimit                  replace the rate limits, {"global":0,"client":0,"files":{"*.img":0}}
+func NewAdminHandler(nexus *FileNexus) http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		entries, size := nexus.Stats()
+		adminJSON(w, http.StatusOK, AdminStatus{
+			Paused:          Paused(),
+			ActiveTransfers: len(ActiveTransfers()),
+			CacheEntries:    entries,
+			CacheBytes:      size,
+		})
+	})
+
+	mux.HandleFunc("/transfers", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodGet) {
+			return
+		}
+		adminJSON(w, http.StatusOK, ActiveTransfers())
+	})
+
+	mux.HandleFunc("/transfers/", func(w http.ResponseWriter, r *http.Request) {
+		// /transfers/{id} or /transfers/{id}/abort
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/transfers/"), "/")
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "abort") {
+			adminError(w, http.StatusNotFound, "no such resource: %s", r.URL.Path)
+			return
+		}
+		t := FindTransfer(id)
+		if t == nil {
+			adminError(w, http.StatusNotFound, "no active transfer: %d", id)
+			return
+		}
+
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			adminJSON(w, http.StatusOK, t.Snapshot())
+		case len(parts) == 1 && r.Method == http.MethodDelete, len(parts) == 2 && r.Method == http.MethodPost:
+			t.Info("abort requested by operator", "admin", r.RemoteAddr)
+			t.Abort()
+			adminJSON(w, http.StatusAccepted, t.Snapshot())
+		case len(parts) == 1:
+			adminMethod(w, r, http.MethodGet, http.MethodDelete)
+		default:
+			adminMethod(w, r, http.MethodPost)
+		}
+	})
+
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminJSON(w, http.StatusOK, nexus.List())
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if name == "" {
+				adminError(w, http.StatusBadRequest, "name is required")
+				return
+			}
+			if !nexus.Evict(name) {
+				adminError(w, http.StatusNotFound, "not cached: %s", name)
+				return
+			}
+			logger.Info("admin: evicted", "file", name, "admin", r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			adminMethod(w, r, http.MethodGet, http.MethodDelete)
+		}
+	})
+
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		paused.Store(true)
+		logger.Info("admin: paused, refusing new requests", "admin", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if !adminMethod(w, r, http.MethodPost) {
+			return
+		}
+		paused.Store(false)
+		logger.Info("admin: resumed, accepting new requests", "admin", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/ratelimit", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminJSON(w, http.StatusOK, rateLimiter.Limits())
+		case http.MethodPut:
+			var limits RateLimits
+			if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+				adminError(w, http.StatusBadRequest, "invalid limits: %s", err.Error())
+				return
+			}
+			rateLimiter.SetLimits(limits)
+			logger.Info("admin: rate limits changed", "global", limits.Global, "client", limits.Client, "files", limits.Files, "admin", r.RemoteAddr)
+			adminJSON(w, http.StatusOK, rateLimiter.Limits())
+		default:
+			adminMethod(w, r, http.MethodGet, http.MethodPut)
+		}
+	})
+
+	return mux
+}
+
+// adminMethod checks the request method is one of allowed, replying 405 if not
+func adminMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, method := range allowed {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	adminError(w, http.StatusMethodNotAllowed, "method not allowed: %s", r.Method)
+	return false
+}
+
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, format string, args ...any) {
+	adminJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// ServeAdmin binds addr and serves the admin API on it in the background
+func ServeAdmin(addr string, nexus *FileNexus) error {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("ServeAdmin(): addr:[%s] err.Error():[%s]", addr, err.Error())
+	}
+
+	go func() {
+		err := http.Serve(listener, NewAdminHandler(nexus))
+		logger.Error("admin: stopped", "err", err)
+	}()
+
+	logger.Info("admin: listening", "addr", listener.Addr().String())
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAdminAbortPauseEvict(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "admin.dat")
+	if err := os.WriteFile(filename, make([]byte, 4*MaxDataBlockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	nexus := NewFileNexus()
+	server := startServer(t, nexus)
+
+	admin := httptest.NewServer(NewAdminHandler(nexus))
+	defer admin.Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+
+	// Start a read, then stall it by never ACKing
+	rrq := PacketRequest{OpRRQ, filename, "octet", nil}
+	client.WriteToUDP(rrq.Serialize(), server)
+	if _, _, err := client.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var active []TransferSnapshot
+	var ours TransferSnapshot
+	adminDo(t, admin, http.MethodGet, "/transfers", http.StatusOK, &active)
+	for _, snap := range active {
+		if snap.Filename == filename {
+			ours = snap
+		}
+	}
+	if ours.ID == 0 || ours.Size != 4*MaxDataBlockSize {
+		t.Fatalf("GET /transfers: expected our transfer; got %+v", active)
+	}
+
+	var cache []CacheEntry
+	adminDo(t, admin, http.MethodGet, "/cache", http.StatusOK, &cache)
+	if len(cache) != 1 || cache[0].Name != filename {
+		t.Errorf("GET /cache: expected %s; got %+v", filename, cache)
+	}
+
+	adminDo(t, admin, http.MethodPost, fmt.Sprintf("/transfers/%d/abort", ours.ID), http.StatusAccepted, nil)
+	if opcode := readUntilError(t, client, buf); opcode != OpError {
+		t.Errorf("after abort: expected ERROR; got opcode %d", opcode)
+	}
+
+	// Paused: new requests are refused
+	adminDo(t, admin, http.MethodPost, "/pause", http.StatusNoContent, nil)
+	client.WriteToUDP(rrq.Serialize(), server)
+	if opcode := readUntilError(t, client, buf); opcode != OpError {
+		t.Errorf("while paused: expected ERROR; got opcode %d", opcode)
+	}
+	adminDo(t, admin, http.MethodPost, "/resume", http.StatusNoContent, nil)
+
+	adminDo(t, admin, http.MethodDelete, "/cache?name="+filename, http.StatusNoContent, nil)
+	adminDo(t, admin, http.MethodDelete, "/cache?name="+filename, http.StatusNotFound, nil)
+	adminDo(t, admin, http.MethodPost, "/transfers/999999/abort", http.StatusNotFound, nil)
+}
+
+// readUntilError skips DATA packets, returning the opcode of the first packet that isn't one
+func readUntilError(t *testing.T, client *net.UDPConn, buf []byte) uint16 {
+	for {
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opcode, _, err := ParsePacket(buf[:n])
+		if err != nil || opcode != OpData {
+			return opcode
+		}
+	}
+}
+
+func adminDo(t *testing.T, admin *httptest.Server, method string, path string, status int, v any) {
+	req, _ := http.NewRequest(method, admin.URL+path, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d; got %d", method, path, status, resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+}
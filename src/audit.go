@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// audit is the transfer audit log, nil when disabled
+var audit *AuditLog
+
+// AuditRecord is one line in the audit log, written for every finished transfer
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Transfer    uint64    `json:"transfer"`
+	Client      string    `json:"client"`
+	File        string    `json:"file"`
+	Path        string    `json:"path,omitempty"` // the file served or written, when it isn't the one requested
+	Direction   string    `json:"direction"`
+	Size        int       `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`
+	DurationMs  int64     `json:"duration_ms"`
+	Outcome     string    `json:"outcome"`
+	ErrorCode   *int      `json:"error_code,omitempty"`
+	Quarantined bool      `json:"quarantined,omitempty"`
+}
+
+// AuditLog is an append-only JSON lines file, rotated to path.1 .. path.N once it reaches maxSize bytes
+type AuditLog struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenAuditLog opens (or creates) the audit log for appending
+func OpenAuditLog(path string, maxSize int64, backups int) (*AuditLog, error) {
+
+	a := &AuditLog{path: path, maxSize: maxSize, backups: backups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("AuditLog.open(): path:[%s] err.Error():[%s]", a.path, err.Error())
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("AuditLog.open(): path:[%s] err.Error():[%s]", a.path, err.Error())
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N .. path to path.1, dropping the oldest
+func (a *AuditLog) rotate() error {
+
+	a.file.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.backups))
+	for i := a.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.backups > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return fmt.Errorf("AuditLog.rotate(): path:[%s] err.Error():[%s]", a.path, err.Error())
+		}
+	} else {
+		os.Remove(a.path)
+	}
+
+	return a.open()
+}
+
+// Write appends rec to the log, rotating first if it would grow past maxSize.
+// The file is synced, as a record that isn't on disk isn't an audit record.
+func (a *AuditLog) Write(rec AuditRecord) error {
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("AuditLog.Write(): path:[%s] err.Error():[%s]", a.path, err.Error())
+	}
+
+	return a.file.Sync()
+}
+
+// Record writes the audit record for a finished transfer, it is a no-op when auditing is disabled
+func (a *AuditLog) Record(t *Transfer) {
+
+	if a == nil {
+		return
+	}
+
+	rec := AuditRecord{
+		Time:        time.Now().UTC(),
+		Transfer:    t.ID,
+		Client:      t.Client.String(),
+		File:        t.Filename,
+		Direction:   t.Direction,
+		Size:        t.Bytes,
+		SHA256:      t.SHA256,
+		DurationMs:  time.Since(t.Started).Milliseconds(),
+		Outcome:     t.Outcome(),
+		Quarantined: t.Quarantined,
+	}
+	if t.Path != t.Filename {
+		rec.Path = t.Path
+	}
+	if t.ErrorCode >= 0 {
+		code := t.ErrorCode
+		rec.ErrorCode = &code
+	}
+
+	if err := a.Write(rec); err != nil {
+		t.Error("unable to write audit record", "err", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Room for ~2 records per file
+	a, err := OpenAuditLog(path, 400, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 4242}
+	for i := 0; i < 7; i++ {
+		tr := NewTransfer(nil, client, DirectionWrite, "crash.dmp")
+		tr.Accept()
+		tr.Bytes = 1000 + i
+		if i%2 == 0 {
+			tr.Completed = true
+			tr.SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+		} else {
+			tr.ErrorCode = int(ErrorDiskFull)
+		}
+		a.Record(tr)
+		tr.Finish()
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, found %s.3", path)
+	}
+
+	// Newest records are in the live file, and each line stands alone
+	var last AuditRecord
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Errorf("%s: unable to parse %q: %s", name, scanner.Text(), err)
+			}
+			if rec.Transfer <= last.Transfer {
+				t.Errorf("%s: records out of order, transfer %d after %d", name, rec.Transfer, last.Transfer)
+			}
+			last = rec
+		}
+		f.Close()
+	}
+
+	if last.Size != 1006 || last.Outcome != OutcomeCompleted || last.ErrorCode != nil || last.SHA256 == "" {
+		t.Errorf("last record: got %+v", last)
+	}
+}
+
+func TestAuditRefusals(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "fw.img"), []byte("firmware"), 0644)
+
+	a, err := OpenAuditLog(filepath.Join(dir, "audit.log"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, only, _ := net.ParseCIDR("127.0.0.1/32")
+	t.Cleanup(func() { audit, vroots = nil, nil; paused.Store(false) })
+	audit = a
+	vroots = NewVirtualRoots([]VirtualRoot{{Subnet: only, Dir: dir}})
+	server := startServer(t, NewFileNexus())
+
+	// Served from the root: the record has the file on disk as well as the name asked for
+	if _, err := tftpGet(server, "fw.img"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused before the request is looked at: paused, or no root for the client
+	paused.Store(true)
+	if _, err := tftpGet(server, "fw.img"); err == nil {
+		t.Errorf("paused: expected an error")
+	}
+	paused.Store(false)
+	if _, err := tftpGetFrom(net.IPv4(127, 0, 0, 2), server, "fw.img"); err == nil {
+		t.Errorf("no root: expected an error")
+	}
+
+	var records []AuditRecord
+	for deadline := time.Now().Add(5 * time.Second); len(records) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = nil
+		file, _ := os.Open(filepath.Join(dir, "audit.log"))
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var rec AuditRecord
+			json.Unmarshal(scanner.Bytes(), &rec)
+			records = append(records, rec)
+		}
+		file.Close()
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records; got %+v", records)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Transfer < records[j].Transfer }) // in the order finished
+	if records[0].Outcome != OutcomeCompleted || records[0].File != "fw.img" || records[0].Path != filepath.Join(dir, "fw.img") {
+		t.Errorf("served: unexpected record %+v", records[0])
+	}
+	for i, code := range []uint16{ErrorNotDefined, ErrorFileAccessViolation} {
+		rec := records[i+1]
+		if rec.Outcome != OutcomeRejected || rec.ErrorCode == nil || *rec.ErrorCode != int(code) || rec.File != "fw.img" {
+			t.Errorf("refusal %d: unexpected record %+v", i+1, rec)
+		}
+	}
+}
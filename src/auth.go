@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authWindow is how far a request's auth-time may be from the server's clock, and how long its nonce is remembered
+const authWindow = 5 * time.Minute
+
+// authMinSecret is the shortest secret taken, in bytes
+const authMinSecret = 16
+
+// authKeys checks authenticated requests, nil when there are no keys (auth options are then ignored)
+var authKeys *AuthKeys
+
+// AuthKey is a pre-shared key, and the paths it may read and write: path.Match globs, "dir/" for everything
+// under dir, or "*" for every path
+type AuthKey struct {
+	ID     string
+	Secret []byte
+	Read   bool
+	Write  bool
+	Paths  []string
+}
+
+// AuthKeys authenticates requests carrying the auth-* options (see README) with pre-shared keys, and remembers
+// their nonces so a request can't be replayed
+type AuthKeys struct {
+	RequireWrites bool // refuse WRQs that aren't authenticated
+
+	keys   map[string]*AuthKey
+	mu     sync.Mutex
+	nonces map[string]time.Time // "id nonce" of the requests seen in the last authWindow
+}
+
+// authSession is an authenticated request
+type authSession struct {
+	key    *AuthKey
+	mac    string // the request's auth-mac, the OACK's is computed over it
+	sha256 string // WRQ: the checksum the upload has to match
+}
+
+// NewAuthKeys creates the struct
+func NewAuthKeys(keys []AuthKey, requireWrites bool) *AuthKeys {
+
+	a := &AuthKeys{
+		RequireWrites: requireWrites,
+		keys:          make(map[string]*AuthKey),
+		nonces:        make(map[string]time.Time),
+	}
+	for i := range keys {
+		a.keys[keys[i].ID] = &keys[i]
+	}
+
+	return a
+}
+
+// AuthMAC is the hex HMAC-SHA256 of fields, joined by NULs, under secret; clients compute a request's auth-mac
+// with it, and check the OACK's
+func AuthMAC(secret []byte, fields ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate checks the auth-* options of a request, nil if it has none; op is OpRRQ or OpWRQ, and filename
+// the name as requested
+func (a *AuthKeys) Authenticate(op uint16, filename string, options map[string]string) (*authSession, error) {
+
+	id, ok := options["auth-key"]
+	if a == nil || !ok {
+		return nil, nil
+	}
+
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Authenticate(): unknown key:[%s]", id)
+	}
+	stamp, nonce, sum, mac := options["auth-time"], options["auth-nonce"], options["auth-sha256"], options["auth-mac"]
+	if len(nonce) < 16 || mac == "" || (op == OpWRQ && len(sum) != sha256.Size*2) {
+		return nil, fmt.Errorf("Authenticate(): key:[%s] expected auth-time, auth-nonce, auth-mac (and auth-sha256 for a write)", id)
+	}
+	opName := "RRQ"
+	if op == OpWRQ {
+		opName = "WRQ"
+	} else {
+		sum = ""
+	}
+	if !hmac.Equal([]byte(strings.ToLower(mac)), []byte(AuthMAC(key.Secret, opName, filename, stamp, nonce, sum))) {
+		return nil, fmt.Errorf("Authenticate(): key:[%s] bad auth-mac", id)
+	}
+
+	// Fresh, and not seen before
+	seconds, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Authenticate(): key:[%s] auth-time:[%s] err.Error():[%s]", id, stamp, err.Error())
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(seconds, 0)); math.Abs(float64(skew)) > float64(authWindow) {
+		return nil, fmt.Errorf("Authenticate(): key:[%s] auth-time is %s off the server's clock", id, skew.Round(time.Second))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for seen, at := range a.nonces {
+		if now.Sub(at) > 2*authWindow {
+			delete(a.nonces, seen)
+		}
+	}
+	if _, ok := a.nonces[id+" "+nonce]; ok {
+		return nil, fmt.Errorf("Authenticate(): key:[%s] replayed auth-nonce:[%s]", id, nonce)
+	}
+	a.nonces[id+" "+nonce] = now
+
+	return &authSession{key: key, mac: strings.ToLower(mac), sha256: strings.ToLower(sum)}, nil
+}
+
+// Authorize checks that a request may go ahead: s (nil if it isn't authenticated) may read or write filename,
+// the name the request maps to under the client's root (see Transfer.Name)
+func (a *AuthKeys) Authorize(s *authSession, op uint16, filename string) error {
+
+	if a == nil {
+		return nil
+	}
+	if s == nil {
+		if op == OpWRQ && a.RequireWrites {
+			return fmt.Errorf("Authorize(): writes need an authenticated request, file:[%s]", filename)
+		}
+		return nil
+	}
+
+	if op == OpRRQ && (!s.key.Read || !s.key.allows(filename)) {
+		return fmt.Errorf("Authorize(): key:[%s] may not read file:[%s]", s.key.ID, filename)
+	}
+	if op == OpWRQ && (!s.key.Write || !s.key.allows(filename)) {
+		return fmt.Errorf("Authorize(): key:[%s] may not write file:[%s]", s.key.ID, filename)
+	}
+	return nil
+}
+
+// allows reports whether filename is under one of the key's paths
+func (k *AuthKey) allows(filename string) bool {
+
+	name := strings.TrimLeft(path.Clean("/"+filename), "/")
+	for _, pattern := range k.Paths {
+		if pattern == "*" {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(name, strings.TrimLeft(pattern, "/")) {
+			return true
+		}
+		if matched, _ := path.Match(strings.TrimLeft(pattern, "/"), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// oack adds the server's answer to options: the key, the file's checksum for a read (sum, "" for a write), and an
+// auth-mac over the request's auth-mac and the checksum, proving the server has the key
+func (s *authSession) oack(options map[string]string, sum string) map[string]string {
+
+	if options == nil {
+		options = make(map[string]string)
+	}
+	options["auth-key"] = s.key.ID
+	if sum != "" {
+		options["auth-sha256"] = sum
+	}
+	options["auth-mac"] = AuthMAC(s.key.Secret, "OACK", s.mac, sum)
+
+	return options
+}
+
+// readOACK adds the server's answer to the options of an authenticated RRQ, the whole file loaded for its checksum;
+// it returns the entry's bytes as they now are
+func (s *authSession) readOACK(t *Transfer, nexus *FileNexus, entry *FileEntry, options map[string]string) (map[string]string, []byte, error) {
+
+	data, err := nexus.waitFor(t, entry, math.MaxInt)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum, err := nexus.sha256sum(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.oack(options, sum), data, nil
+}
+
+// LoadAuthKeys reads a key file
+func LoadAuthKeys(path string) ([]AuthKey, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadAuthKeys(): path:[%s] err.Error():[%s]", path, err.Error())
+	}
+	defer file.Close()
+
+	keys, err := ParseAuthKeys(file)
+	if err != nil {
+		return nil, fmt.Errorf("LoadAuthKeys(): path:[%s] %s", path, err.Error())
+	}
+
+	return keys, nil
+}
+
+// ParseAuthKeys parses "id secret access path..." lines, blank lines and '#' comments skipped: the secret is hex,
+// access is r, w or rw
+func ParseAuthKeys(r io.Reader) ([]AuthKey, error) {
+
+	var keys []AuthKey
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line:[%d] expected: id secret access path..., got:[%s]", n, line)
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("line:[%d] duplicate key:[%s]", n, fields[0])
+		}
+		seen[fields[0]] = true
+
+		secret, err := hex.DecodeString(fields[1])
+		if err != nil || len(secret) < authMinSecret {
+			return nil, fmt.Errorf("line:[%d] expected a secret of at least %d hex bytes", n, authMinSecret)
+		}
+		key := AuthKey{ID: fields[0], Secret: secret, Paths: fields[3:]}
+		switch fields[2] {
+		case "r":
+			key.Read = true
+		case "w":
+			key.Write = true
+		case "rw":
+			key.Read, key.Write = true, true
+		default:
+			return nil, fmt.Errorf("line:[%d] expected access r, w or rw, got:[%s]", n, fields[2])
+		}
+		keys = append(keys, key)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authOptions are the auth-* options of a request for filename signed with secret, sum only for a WRQ
+func authOptions(id string, secret []byte, op string, filename string, nonce string, sum string) map[string]string {
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	options := map[string]string{
+		"auth-key":   id,
+		"auth-time":  stamp,
+		"auth-nonce": nonce,
+		"auth-mac":   AuthMAC(secret, op, filename, stamp, nonce, sum),
+	}
+	if sum != "" {
+		options["auth-sha256"] = sum
+	}
+	return options
+}
+
+func TestParseAuthKeys(t *testing.T) {
+	keys, err := ParseAuthKeys(strings.NewReader("# id secret access paths\nci 00112233445566778899aabbccddeeff rw images/ *.cfg\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Read || !keys[0].Write || len(keys[0].Secret) != 16 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	for name, expected := range map[string]bool{"images/a.img": true, "/images/sub/b.img": true, "board.cfg": true, "imagesx/a.img": false, "sub/board.cfg": false} {
+		if keys[0].allows(name) != expected {
+			t.Errorf("%s: expected allowed %v", name, expected)
+		}
+	}
+
+	for _, bad := range []string{
+		"ci 00112233445566778899aabbccddeeff rw",
+		"ci 0011 rw *",
+		"ci 00112233445566778899aabbccddeeff rwx *",
+		"ci 00112233445566778899aabbccddeeff r *\nci 00112233445566778899aabbccddeeff w *",
+	} {
+		if _, err := ParseAuthKeys(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestAuthenticatedTransfers(t *testing.T) {
+	dir := t.TempDir()
+	images := filepath.Join(dir, "images")
+	os.Mkdir(images, 0755)
+	image := bytes.Repeat([]byte("firmware"), 300)
+	os.WriteFile(filepath.Join(images, "fw.img"), image, 0644)
+	os.WriteFile(filepath.Join(dir, "secret.img"), []byte("secret"), 0644)
+
+	ci, bench := []byte("0123456789abcdef-ci"), []byte("0123456789abcdef-bench")
+	t.Cleanup(func() { authKeys = nil })
+	authKeys = NewAuthKeys([]AuthKey{
+		{ID: "ci", Secret: ci, Read: true, Write: true, Paths: []string{images + "/"}},
+		{ID: "bench", Secret: bench, Read: true, Paths: []string{"*"}},
+	}, true)
+	server := startServer(t, NewFileNexus())
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	// Plain reads are still served, for PXE ROMs
+	fw := filepath.Join(images, "fw.img")
+	if data, err := tftpGet(server, fw); err != nil || !bytes.Equal(data, image) {
+		t.Fatalf("plain read: %v", err)
+	}
+
+	// An authenticated read: the OACK proves the server has the key, and gives the file's checksum
+	options := authOptions("ci", ci, "RRQ", fw, "00000000000000000001", "")
+	data, oack, err := tftpGetOptions(localhost, server, fw, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image)
+	if !bytes.Equal(data, image) || oack["auth-sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the file and its sha256; got %d bytes, oack %v", len(data), oack)
+	}
+	if oack["auth-mac"] != AuthMAC(ci, "OACK", options["auth-mac"], oack["auth-sha256"]) {
+		t.Errorf("unexpected oack auth-mac %v", oack)
+	}
+
+	// Replayed, signed with the wrong key, or outside the key's paths: refused
+	refused := []struct {
+		what    string
+		file    string
+		options map[string]string
+	}{
+		{"replay", fw, options},
+		{"wrong key", fw, authOptions("ci", bench, "RRQ", fw, "00000000000000000002", "")},
+		{"other file", fw, authOptions("ci", ci, "RRQ", filepath.Join(dir, "secret.img"), "00000000000000000003", "")},
+		{"outside paths", filepath.Join(dir, "secret.img"), authOptions("ci", ci, "RRQ", filepath.Join(dir, "secret.img"), "00000000000000000004", "")},
+	}
+	for _, r := range refused {
+		_, _, err := tftpGetOptions(localhost, server, r.file, r.options)
+		if err == nil || !strings.Contains(err.Error(), "code:[2]") {
+			t.Errorf("%s: expected an access violation; got %v", r.what, err)
+		}
+	}
+
+	// Writes need a key that may write there, and the file it signed for
+	upload := bytes.Repeat([]byte("new build "), 200)
+	sum = sha256.Sum256(upload)
+	uploadSum := hex.EncodeToString(sum[:])
+	target := filepath.Join(images, "new.img")
+	if err := tftpPut(server, target, upload); err == nil || !strings.Contains(err.Error(), "code:[2]") {
+		t.Errorf("plain write: expected an access violation; got %v", err)
+	}
+	if _, err := tftpPutOptions(server, target, upload, authOptions("bench", bench, "WRQ", target, "00000000000000000005", uploadSum)); err == nil {
+		t.Errorf("read-only key: expected the write refused")
+	}
+	if _, err := tftpPutOptions(server, target, []byte("tampered"), authOptions("ci", ci, "WRQ", target, "00000000000000000006", uploadSum)); err == nil {
+		t.Errorf("tampered upload: expected the write refused")
+	}
+	if _, err := os.Stat(target); err == nil {
+		t.Fatalf("expected no file after refused writes")
+	}
+
+	options = authOptions("ci", ci, "WRQ", target, "00000000000000000007", uploadSum)
+	oack, err = tftpPutOptions(server, target, upload, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oack["auth-mac"] != AuthMAC(ci, "OACK", options["auth-mac"], "") {
+		t.Errorf("unexpected oack %v", oack)
+	}
+	if saved, _ := os.ReadFile(target); !bytes.Equal(saved, upload) {
+		t.Errorf("expected the upload saved; got %d bytes", len(saved))
+	}
+}
+
+func TestAuthenticatedTransfersUnderRoot(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "images"), 0755)
+	image := []byte("firmware under a root")
+	os.WriteFile(filepath.Join(dir, "images", "fw.img"), image, 0644)
+	os.WriteFile(filepath.Join(dir, "secret.img"), []byte("secret"), 0644)
+
+	// The key's paths are names under the client's root, not paths on disk
+	ci := []byte("0123456789abcdef-ci")
+	t.Cleanup(func() { authKeys, vroots = nil, nil })
+	authKeys = NewAuthKeys([]AuthKey{{ID: "ci", Secret: ci, Read: true, Write: true, Paths: []string{"images/"}}}, true)
+	vroots = NewVirtualRoots([]VirtualRoot{{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, Dir: dir}})
+	server := startServer(t, NewFileNexus())
+	localhost := net.IPv4(127, 0, 0, 1)
+
+	options := authOptions("ci", ci, "RRQ", "images/fw.img", "00000000000000000001", "")
+	if data, _, err := tftpGetOptions(localhost, server, "images/fw.img", options); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("read under the key's paths: %q, err:%v", data, err)
+	}
+	options = authOptions("ci", ci, "RRQ", "secret.img", "00000000000000000002", "")
+	if _, _, err := tftpGetOptions(localhost, server, "secret.img", options); err == nil || !strings.Contains(err.Error(), "code:[2]") {
+		t.Errorf("read outside the key's paths: expected an access violation; got %v", err)
+	}
+
+	upload := []byte("new build under a root")
+	sum := sha256.Sum256(upload)
+	uploadSum := hex.EncodeToString(sum[:])
+	if _, err := tftpPutOptions(server, "/images/new.img", upload, authOptions("ci", ci, "WRQ", "/images/new.img", "00000000000000000003", uploadSum)); err != nil {
+		t.Errorf("write under the key's paths: %v", err)
+	}
+	if saved, _ := os.ReadFile(filepath.Join(dir, "images", "new.img")); !bytes.Equal(saved, upload) {
+		t.Errorf("expected the upload saved under the root; got %q", saved)
+	}
+}
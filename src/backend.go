@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendHeaderTimeout bounds the wait for a backend to start answering, the download itself can take longer
+const backendHeaderTimeout = 30 * time.Second
+
+// backendIdleTimeout is how long a download (or decompression) may go without a byte before it is abandoned, and
+// how long a reader waits for one
+var backendIdleTimeout = 30 * time.Second
+
+// ErrBackendNotFound is a backend's answer for a file it doesn't have
+var ErrBackendNotFound = errors.New("not found on backend")
+
+// backend is where an RRQ that misses locally is fetched from, nil when there is none;
+// backendRevalidate is how long a fetched file is served before asking the backend if it has changed
+var backend Backend
+var backendRevalidate time.Duration
+
+// Backend is an upstream store of files, such as an HTTP artefact store or an S3 bucket
+type Backend interface {
+	// Fetch opens name, or says it hasn't changed since cached (a response with the same validators)
+	Fetch(ctx context.Context, name string, cached *BackendResponse) (*BackendResponse, error)
+}
+
+// BackendResponse is a file being fetched: Body is nil when NotModified
+type BackendResponse struct {
+	Body         io.ReadCloser
+	Size         int64 // -1 if unknown
+	NotModified  bool
+	ETag         string
+	LastModified string
+}
+
+// NewBackend creates the backend for a spec: "s3://bucket/prefix" or an http(s):// base URL
+func NewBackend(spec string) (Backend, error) {
+	if strings.HasPrefix(spec, "s3://") {
+		return NewS3Backend(spec)
+	}
+	return NewHTTPBackend(spec)
+}
+
+// HTTPBackend fetches files with GET, from under a base URL
+type HTTPBackend struct {
+	Base   *url.URL
+	Client *http.Client
+}
+
+// NewHTTPBackend creates the struct
+func NewHTTPBackend(base string) (*HTTPBackend, error) {
+
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("NewHTTPBackend(): expected an http(s):// URL, got:[%s]", base)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = backendHeaderTimeout
+
+	return &HTTPBackend{Base: u, Client: &http.Client{Transport: transport}}, nil
+}
+
+// Fetch is a GET of base/name, conditional (If-None-Match/If-Modified-Since) when there is a cached copy
+func (b *HTTPBackend) Fetch(ctx context.Context, name string, cached *BackendResponse) (*BackendResponse, error) {
+
+	u := *b.Base
+	u.Path = path.Join("/", u.Path, name)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached != nil && cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close()
+		return &BackendResponse{NotModified: true}, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		resp.Body.Close()
+		return nil, ErrBackendNotFound
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTPBackend.Fetch(): url:[%s] status:[%s]", u.String(), resp.Status)
+	}
+
+	return &BackendResponse{
+		Body:         resp.Body,
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// backendName is the name a backend knows a file by: its path under the virtual root, without a leading '/'
+func backendName(root string, filename string) string {
+	name := strings.TrimPrefix(filename, root)
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+}
+
+// backendFetch is a request to the backend in flight, misses for the same file meanwhile wait for its answer
+// instead of sending their own
+type backendFetch struct {
+	done  chan struct{}
+	entry *FileEntry
+	err   error
+}
+
+// GetBackendEntry will retrieve the Entry for a file from the backend, the cached copy if it is current (or
+// still downloading); a new download is returned as soon as it starts, see waitFor. One request per file goes to
+// the backend at a time.
+func (nexus *FileNexus) GetBackendEntry(b Backend, remoteAddr string, filename string, name string) (*FileEntry, error) {
+
+	key := nexus.makeHashKey(remoteAddr, filename)
+
+	nexus.mapAccessMutex.Lock()
+	if call, ok := nexus.fetches[key]; ok {
+		nexus.mapAccessMutex.Unlock()
+		<-call.done
+		return call.entry, call.err
+	}
+	call := &backendFetch{done: make(chan struct{})}
+	nexus.fetches[key] = call
+	nexus.mapAccessMutex.Unlock()
+
+	call.entry, call.err = nexus.fetchBackendEntry(b, key, name)
+
+	nexus.mapAccessMutex.Lock()
+	delete(nexus.fetches, key)
+	nexus.mapAccessMutex.Unlock()
+	close(call.done)
+
+	return call.entry, call.err
+}
+
+// fetchBackendEntry does GetBackendEntry's work, for the one request to the backend
+func (nexus *FileNexus) fetchBackendEntry(b Backend, key string, name string) (*FileEntry, error) {
+
+	nexus.mapAccessMutex.RLock()
+	cached, ok := nexus.entries[key]
+	nexus.mapAccessMutex.RUnlock()
+	if !ok || cached.source == nil {
+		cached = nil
+	}
+
+	if cached != nil {
+		cached.fill.mu.Lock()
+		current := !cached.fill.done || time.Since(cached.checked) < backendRevalidate
+		cached.fill.mu.Unlock()
+		if current {
+			return cached, nil
+		}
+	}
+
+	var validators *BackendResponse
+	if cached != nil {
+		validators = cached.source
+	}
+	resp, err := b.Fetch(context.Background(), name, validators)
+	if err != nil {
+		if cached != nil && !errors.Is(err, ErrBackendNotFound) {
+			logger.Warn("backend: unable to revalidate, serving cached copy", "file", name, "err", err)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("GetBackendEntry(): name:[%s] err.Error():[%s]", name, err.Error())
+	}
+
+	if resp.NotModified {
+		cached.fill.mu.Lock()
+		cached.checked = time.Now()
+		cached.fill.mu.Unlock()
+		return cached, nil
+	}
+
+	// Download in the background, readers send what has arrived (see waitFor)
+	entry := NewFileEntry()
+	entry.Bytes = []byte{}
+	entry.source = &BackendResponse{ETag: resp.ETag, LastModified: resp.LastModified}
+	entry.checked = time.Now()
+	entry.fill = &entryFill{size: int(resp.Size)}
+	entry.fill.cond = sync.NewCond(&entry.fill.mu)
+	if resp.Size > 0 {
+		entry.Bytes = make([]byte, 0, resp.Size)
+	}
+
+	nexus.mapAccessMutex.Lock()
+	nexus.entries[key] = entry
+	nexus.mapAccessMutex.Unlock()
+
+	logger.Info("backend: fetching", "file", name, "size", resp.Size)
+	go nexus.fill(key, entry, resp.Body)
+
+	return entry, nil
+}
+
+// fill copies a download (or decompression) into the entry, dropping it from the nexus if it fails
+func (nexus *FileNexus) fill(key string, entry *FileEntry, body io.ReadCloser) {
+
+	defer body.Close()
+
+	// A body that stops sending is closed, which ends the Read it is stuck in
+	idleTimeout := backendIdleTimeout
+	var stalled atomic.Bool
+	idle := time.AfterFunc(idleTimeout, func() {
+		stalled.Store(true)
+		body.Close()
+	})
+	defer idle.Stop()
+
+	f := entry.fill
+	buf := make([]byte, 32*1024)
+	var err error
+	for {
+		var n int
+		n, err = body.Read(buf)
+		idle.Reset(idleTimeout)
+		if n > 0 {
+			nexus.mapAccessMutex.Lock()
+			entry.Bytes = append(entry.Bytes, buf[:n]...)
+			total := len(entry.Bytes)
+			nexus.mapAccessMutex.Unlock()
+
+			f.mu.Lock()
+			f.n = total
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if stalled.Load() {
+		err = fmt.Errorf("FileNexus.fill(): key:[%s] nothing received for %s", key, idleTimeout)
+	}
+	if err == nil && f.size >= 0 && f.n != f.size {
+		err = fmt.Errorf("FileNexus.fill(): key:[%s] expected:[%d] got:[%d] bytes", key, f.size, f.n)
+	}
+
+	if err != nil {
+		logger.Error("nexus: fill failed", "file", key, "err", err)
+		nexus.mapAccessMutex.Lock()
+		if nexus.entries[key] == entry {
+			delete(nexus.entries, key)
+		}
+		nexus.mapAccessMutex.Unlock()
+	} else {
+		logger.Info("nexus: filled", "file", key, "size", f.n)
+	}
+
+	f.mu.Lock()
+	f.done, f.err = true, err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPBackend(t *testing.T) {
+	var mu sync.Mutex
+	content, etag := bytes.Repeat([]byte("0123456789abcdef"), 1000), `"v1"`
+	release := make(chan struct{})
+	fulls, notModified := 0, 0
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		data, tag := content, etag
+		mu.Unlock()
+
+		if r.URL.Path != "/artefacts/images/boot.img" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == tag {
+			mu.Lock()
+			notModified++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		mu.Lock()
+		fulls++
+		mu.Unlock()
+
+		// Half now, the rest once the test has seen blocks go out
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(data[len(data)/2:])
+	}))
+	defer origin.Close()
+
+	t.Cleanup(func() { backend, backendRevalidate = nil, 0 })
+	backend, _ = NewHTTPBackend(origin.URL + "/artefacts")
+	t.Cleanup(func() { vroots = nil })
+	vroots = NewVirtualRoots([]VirtualRoot{{Dir: t.TempDir()}})
+	server := startServer(t, NewFileNexus())
+
+	// Streamed: the client gets blocks while the origin is still sending
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		data, err := tftpGet(server, "images/boot.img")
+		done <- result{data, err}
+	}()
+	streaming := false
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !streaming; time.Sleep(10 * time.Millisecond) {
+		for _, tr := range ActiveTransfers() {
+			streaming = streaming || (strings.HasSuffix(tr.Filename, "boot.img") && tr.Bytes > 0)
+		}
+	}
+	close(release)
+	r := <-done
+	if !streaming {
+		t.Errorf("expected blocks sent before the origin finished")
+	}
+	if r.err != nil || !bytes.Equal(r.data, content) {
+		t.Fatalf("first get: %d bytes, err:%v", len(r.data), r.err)
+	}
+
+	// Cached, and revalidated with the ETag
+	if data, err := tftpGet(server, "images/boot.img"); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("second get: %d bytes, err:%v", len(data), err)
+	}
+
+	// Changed on the origin
+	mu.Lock()
+	content, etag = []byte("a new image"), `"v2"`
+	mu.Unlock()
+	if data, err := tftpGet(server, "images/boot.img"); err != nil || string(data) != "a new image" {
+		t.Errorf("after change: %q, err:%v", data, err)
+	}
+
+	mu.Lock()
+	if fulls != 2 || notModified != 1 {
+		t.Errorf("expected 2 downloads and 1 not modified; got %d and %d", fulls, notModified)
+	}
+	mu.Unlock()
+
+	if _, err := tftpGet(server, "images/missing.img"); err == nil || !strings.Contains(err.Error(), "code:[1]") {
+		t.Errorf("missing: expected ErrorFileNotFound; got %v", err)
+	}
+}
+
+func TestBackendStalls(t *testing.T) {
+	var mu sync.Mutex
+	gets := 0
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+
+		// Slow to answer, then half the file and nothing more
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Length", "2000")
+		w.Write(make([]byte, 1000))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	idle := backendIdleTimeout
+	t.Cleanup(func() { backendIdleTimeout = idle })
+	backendIdleTimeout = 300 * time.Millisecond
+	b, _ := NewHTTPBackend(origin.URL)
+	nexus := NewFileNexus()
+
+	// Misses at the same time share one request
+	entries := make(chan *FileEntry, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			entry, _ := nexus.GetBackendEntry(b, "127.0.0.1:1000", "stalled.img", "stalled.img")
+			entries <- entry
+		}()
+	}
+	first := <-entries
+	for i := 1; i < 5; i++ {
+		if entry := <-entries; entry != first {
+			t.Errorf("expected every miss to get the same entry")
+		}
+	}
+	mu.Lock()
+	if gets != 1 {
+		t.Errorf("expected 1 GET for concurrent misses; got %d", gets)
+	}
+	mu.Unlock()
+
+	// A body that stops sending ends the download, and whoever waits for it
+	start := time.Now()
+	if _, err := nexus.waitFor(nil, first, 2000); err == nil {
+		t.Errorf("expected the stalled download to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the stall noticed after ~%s; took %s", backendIdleTimeout, elapsed)
+	}
+
+	// An operator's abort ends the wait too
+	entry := NewFileEntry()
+	entry.fill = &entryFill{size: -1}
+	entry.fill.cond = sync.NewCond(&entry.fill.mu)
+	transfer := &Transfer{}
+	time.AfterFunc(50*time.Millisecond, transfer.Abort)
+	if _, err := nexus.waitFor(transfer, entry, 1); err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Errorf("expected the wait aborted; got %v", err)
+	}
+}
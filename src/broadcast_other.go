@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// enableBroadcast is a no-op on this platform, broadcast replies may be refused
+func enableBroadcast(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// casMinAge keeps the garbage collector off blobs just written, that may be about to be linked
+const casMinAge = time.Minute
+
+// cas stores uploads by content, nil when uploads are written as plain files
+var cas *CASStore
+
+// CASStore keeps each distinct upload once, as a read-only blob named by its SHA-256; the names clients
+// upload to are the index, each a hard link to its blob, so a blob's link count is its reference count
+type CASStore struct {
+	Dir string
+}
+
+// OpenCASStore creates the blob directory if needed, it must be on the same filesystem as the uploads
+func OpenCASStore(dir string) (*CASStore, error) {
+
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, fmt.Errorf("OpenCASStore(): dir:[%s] err.Error():[%s]", dir, err.Error())
+	}
+
+	return &CASStore{Dir: dir}, nil
+}
+
+// blobPath is where the blob for a checksum lives, fanned out by its first byte
+func (c *CASStore) blobPath(sum string) string {
+	return filepath.Join(c.Dir, sum[:2], sum)
+}
+
+// Save stores data once and points filename at it, replacing what was there
+func (c *CASStore) Save(filename string, data []byte) error {
+
+	digest := sha256.Sum256(data)
+	sum := hex.EncodeToString(digest[:])
+	blob := c.blobPath(sum)
+
+	// The collector may remove an unlinked blob between the write and the link, so try again once
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = c.writeBlob(blob, data); err != nil {
+			return err
+		}
+		if err = c.link(blob, filename); err == nil || !isNotExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("CASStore.Save(): file:[%s] blob:[%s] err.Error():[%s]", filename, sum, err.Error())
+	}
+
+	return nil
+}
+
+// writeBlob writes a blob unless it is already there
+func (c *CASStore) writeBlob(blob string, data []byte) error {
+
+	if fileExists(blob) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.Dir, "tmp"), "blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Read-only: every name linked to it would see an in-place edit
+		err = os.Chmod(tmp.Name(), 0444)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), blob)
+}
+
+// link points filename at blob: a new link next to it, renamed over it, so readers never see it missing
+func (c *CASStore) link(blob string, filename string) error {
+
+	if current, err := os.Stat(filename); err == nil {
+		if stored, err := os.Stat(blob); err == nil && os.SameFile(current, stored) {
+			return nil
+		}
+	}
+
+	tmp := fmt.Sprintf("%s.cas-%d", filename, time.Now().UnixNano())
+	if err := os.Link(blob, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Collect removes the blobs no name links to any more, it returns how many were removed
+func (c *CASStore) Collect() (int, error) {
+
+	removed := 0
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == filepath.Join(c.Dir, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		links, ok := linkCount(info)
+		if !ok || links > 1 || time.Since(info.ModTime()) < casMinAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("CASStore.Collect(): dir:[%s] err.Error():[%s]", c.Dir, err.Error())
+	}
+
+	return removed, nil
+}
+
+// CollectEvery runs Collect in the background, every interval
+func (c *CASStore) CollectEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			removed, err := c.Collect()
+			if err != nil {
+				logger.Error("cas: garbage collection failed", "err", err)
+			} else if removed > 0 {
+				logger.Info("cas: garbage collected", "blobs", removed)
+			}
+		}
+	}()
+}
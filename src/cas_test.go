@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCASStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenCASStore(filepath.Join(dir, ".cas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same content under two names is one blob
+	a, b := filepath.Join(dir, "a.cfg"), filepath.Join(dir, "b.cfg")
+	for _, name := range []string{a, b} {
+		if err := store.Save(name, []byte("hostname sw1\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infoA, _ := os.Stat(a)
+	infoB, _ := os.Stat(b)
+	if infoA == nil || infoB == nil || !os.SameFile(infoA, infoB) {
+		t.Errorf("expected a.cfg and b.cfg to be the same blob")
+	}
+	if blobs := countBlobs(t, store); blobs != 1 {
+		t.Errorf("expected 1 blob; got %d", blobs)
+	}
+
+	// Overwriting one name leaves the other as it was
+	if err := store.Save(b, []byte("hostname sw2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(a); string(data) != "hostname sw1\n" {
+		t.Errorf("a.cfg changed to %q", data)
+	}
+	if data, _ := os.ReadFile(b); string(data) != "hostname sw2\n" {
+		t.Errorf("b.cfg expected the new content; got %q", data)
+	}
+	if blobs := countBlobs(t, store); blobs != 2 {
+		t.Errorf("expected 2 blobs; got %d", blobs)
+	}
+
+	// Garbage collection: only a blob nothing links to, and only once it is old enough
+	if _, ok := linkCount(infoA); !ok {
+		t.Skip("no link counts on this platform")
+	}
+	os.Remove(a)
+	if removed, err := store.Collect(); err != nil || removed != 0 {
+		t.Errorf("expected a new blob to be kept; removed %d, err %v", removed, err)
+	}
+	old := time.Now().Add(-2 * casMinAge)
+	filepath.WalkDir(store.Dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+	if removed, err := store.Collect(); err != nil || removed != 1 {
+		t.Errorf("expected 1 blob removed; removed %d, err %v", removed, err)
+	}
+	if data, _ := os.ReadFile(b); string(data) != "hostname sw2\n" {
+		t.Errorf("b.cfg lost its blob: %q", data)
+	}
+}
+
+func TestCASUploads(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenCASStore(filepath.Join(dir, ".cas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nexus := NewFileNexus()
+	t.Cleanup(func() { cas = nil })
+	cas = store
+	server := startServer(t, nexus)
+
+	backup := make([]byte, 3000)
+	for i := range backup {
+		backup[i] = byte(i)
+	}
+	for _, name := range []string{"sw1.cfg", "sw2.cfg", "sw3.cfg"} {
+		if err := tftpPut(server, filepath.Join(dir, name), backup); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	if blobs := countBlobs(t, store); blobs != 1 {
+		t.Errorf("expected 1 blob for 3 identical uploads; got %d", blobs)
+	}
+
+	// The cache holds them once too
+	if files, size := nexus.Stats(); files != 3 || size != len(backup) {
+		t.Errorf("expected 3 files of %d bytes in all; got %d of %d", len(backup), files, size)
+	}
+	if data, err := tftpGet(server, filepath.Join(dir, "sw2.cfg")); err != nil || len(data) != len(backup) {
+		t.Errorf("read back: %d bytes, err %v", len(data), err)
+	}
+}
+
+func countBlobs(t *testing.T, store *CASStore) int {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(store.Dir, "??", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
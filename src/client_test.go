@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer runs the tftp-server on a loopback port until the test ends
+func startServer(t *testing.T, nexus *FileNexus) *net.UDPAddr {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveUntilCleanup(t, listener, nexus)
+
+	return listener.LocalAddr().(*net.UDPAddr)
+}
+
+// serveUntilCleanup runs the tftp-server on listener, closing it and waiting for Serve to return when
+// the test ends (so it doesn't log into the next test)
+func serveUntilCleanup(t *testing.T, listener *net.UDPConn, nexus *FileNexus) {
+	done := make(chan struct{})
+	go func() {
+		Serve(listener, nexus, 4, 1)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+}
+
+// tftpGet is a minimal RFC1350 client, reading filename from server
+func tftpGet(server *net.UDPAddr, filename string) ([]byte, error) {
+	return tftpGetFrom(net.IPv4(127, 0, 0, 1), server, filename)
+}
+
+// tftpGetFrom is tftpGet, from a client bound to local
+func tftpGetFrom(local net.IP, server *net.UDPAddr, filename string) ([]byte, error) {
+	data, _, err := tftpGetOptions(local, server, filename, nil)
+	return data, err
+}
+
+// tftpGetOptions is tftpGetFrom, requesting options (RFC2347); it returns the options in the server's OACK
+func tftpGetOptions(local net.IP, server *net.UDPAddr, filename string, options map[string]string) ([]byte, map[string]string, error) {
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	rrq := PacketRequest{OpRRQ, filename, "octet", options}
+	if _, err := conn.WriteToUDP(rrq.Serialize(), server); err != nil {
+		return nil, nil, err
+	}
+
+	var result []byte
+	var oack map[string]string
+	var expected uint16 = 1
+	buf := make([]byte, MaxPacketSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, tid, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The server only ever sends an OACK, ParsePacket doesn't take them
+		if opcode, _, _ := parseUint16(buf[:n]); opcode == OpOAck && expected == 1 {
+			p := PacketOAck{}
+			if err := p.Parse(buf[:n]); err != nil {
+				return nil, nil, err
+			}
+			oack = p.Options
+			ack := PacketAck{0}
+			conn.WriteToUDP(ack.Serialize(), tid)
+			continue
+		}
+
+		_, p, err := ParsePacket(buf[:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		switch p := p.(type) {
+		case *PacketError:
+			return nil, nil, fmt.Errorf("ERROR code:[%d] msg:[%s]", p.Code, p.Msg)
+		case *PacketData:
+			if p.BlockNum == expected {
+				result = append(result, p.Data...)
+				expected++
+			}
+			ack := PacketAck{p.BlockNum}
+			conn.WriteToUDP(ack.Serialize(), tid)
+			if p.BlockNum == expected-1 && len(p.Data) < MaxDataBlockSize {
+				return result, oack, nil
+			}
+		default:
+			return nil, nil, fmt.Errorf("unexpected packet %#v", p)
+		}
+	}
+}
+
+// tftpPut is a minimal RFC1350 client, writing data to filename on server
+func tftpPut(server *net.UDPAddr, filename string, data []byte) error {
+	_, err := tftpPutOptions(server, filename, data, nil)
+	return err
+}
+
+// tftpPutOptions is tftpPut, requesting options (RFC2347); it returns the options in the server's OACK
+func tftpPutOptions(server *net.UDPAddr, filename string, data []byte, options map[string]string) (map[string]string, error) {
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wrq := PacketRequest{OpWRQ, filename, "octet", options}
+	if _, err := conn.WriteToUDP(wrq.Serialize(), server); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	var tid *net.UDPAddr
+	var oack map[string]string
+	var block uint16
+	for pos := 0; ; pos += MaxDataBlockSize {
+
+		// Wait for the ACK of the previous block (or the WRQ, which an OACK answers too)
+		for {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return nil, err
+			}
+			tid = from
+			if opcode, _, _ := parseUint16(buf[:n]); opcode == OpOAck && block == 0 {
+				p := PacketOAck{}
+				if err := p.Parse(buf[:n]); err != nil {
+					return nil, err
+				}
+				oack = p.Options
+				break
+			}
+			_, p, err := ParsePacket(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			if e, ok := p.(*PacketError); ok {
+				return nil, fmt.Errorf("ERROR code:[%d] msg:[%s]", e.Code, e.Msg)
+			}
+			if ack, ok := p.(*PacketAck); ok && ack.BlockNum == block {
+				break
+			}
+		}
+
+		if pos > len(data) {
+			return oack, nil
+		}
+		end := pos + MaxDataBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		block++
+		packet := PacketData{block, data[pos:end]}
+		conn.WriteToUDP(packet.Serialize(), tid)
+	}
+}
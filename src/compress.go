@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressedSuffixes are the compressed copies looked for, in order, when a requested file isn't on disk
+var compressedSuffixes = []string{".gz", ".zst"}
+
+// compressedSizes remembers uncompressed sizes, so tsize can be answered before a file is decompressed again
+var compressedSizes = &sizeCache{sizes: make(map[string]cachedSize)}
+
+// sizeCache maps a compressed file to its uncompressed size
+type sizeCache struct {
+	mu    sync.Mutex
+	sizes map[string]cachedSize
+}
+
+// cachedSize is only good for the compressed file it was taken from: same length, same modification time
+type cachedSize struct {
+	size    int
+	length  int64
+	modTime time.Time
+}
+
+// get returns the uncompressed size of path, -1 if it isn't known (or the file has changed since)
+func (c *sizeCache) get(path string, info os.FileInfo) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.sizes[path]
+	if !ok || cached.length != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		return -1
+	}
+	return cached.size
+}
+
+func (c *sizeCache) set(path string, info os.FileInfo, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sizes[path] = cachedSize{size: size, length: info.Size(), modTime: info.ModTime()}
+}
+
+// compressedFile is the compressed copy of filename to serve, false if filename is on disk itself or there is none
+func compressedFile(filename string) (string, bool) {
+
+	if fileExists(filename) {
+		return "", false
+	}
+	for _, suffix := range compressedSuffixes {
+		if fileExists(filename + suffix) {
+			return filename + suffix, true
+		}
+	}
+	return "", false
+}
+
+// decompress opens a reader of the uncompressed bytes of path, by its suffix: gzip natively, zstd through the
+// zstd command. Corrupt or truncated input is an error from Read, not an early EOF.
+func decompress(path string) (io.ReadCloser, error) {
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("decompress(): path:[%s] err.Error():[%s]", path, err.Error())
+		}
+		return &gzipReader{Reader: gz, file: file}, nil
+
+	case strings.HasSuffix(path, ".zst"):
+		cmd := exec.Command("zstd", "-dc", "--", path)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		r := &commandReader{out: stdout, cmd: cmd}
+		cmd.Stderr = &r.stderr
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("decompress(): path:[%s] err.Error():[%s]", path, err.Error())
+		}
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("decompress(): unknown compression, path:[%s]", path)
+}
+
+// gzipReader closes the file under the gzip stream with it
+type gzipReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// commandReader reads a command's output, its exit status is the error at the end of it
+type commandReader struct {
+	out    io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	waited bool
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.out.Read(p)
+	if errors.Is(err, io.EOF) && !r.waited {
+		r.waited = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s: %s %s", r.cmd.Path, werr.Error(), strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (r *commandReader) Close() error {
+	if !r.waited {
+		r.waited = true
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+	return nil
+}
+
+// GetCompressedEntry will retrieve the Entry for a file served from its compressed copy; a new decompression is
+// returned as soon as it starts, the bytes kept as they come (see waitFor), so a resent block doesn't restart it
+func (nexus *FileNexus) GetCompressedEntry(remoteAddr string, filename string, compressed string) (*FileEntry, error) {
+
+	nexus.mapAccessMutex.Lock()
+	defer nexus.mapAccessMutex.Unlock()
+
+	key := nexus.makeHashKey(remoteAddr, filename)
+	if entry, ok := nexus.entries[key]; ok && (entry.Bytes != nil || entry.fill != nil) {
+		return entry, nil
+	}
+
+	info, err := os.Stat(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("GetCompressedEntry(): file:[%s] err.Error():[%s]", compressed, err.Error())
+	}
+	body, err := decompress(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("GetCompressedEntry(): file:[%s] err.Error():[%s]", compressed, err.Error())
+	}
+
+	entry := NewFileEntry()
+	entry.Bytes = []byte{}
+	entry.fill = &entryFill{size: compressedSizes.get(compressed, info)}
+	entry.fill.cond = sync.NewCond(&entry.fill.mu)
+	if entry.fill.size > 0 {
+		entry.Bytes = make([]byte, 0, entry.fill.size)
+	}
+	nexus.entries[key] = entry
+
+	logger.Info("decompressing", "file", compressed, "size", entry.fill.size)
+	go func() {
+		nexus.fill(key, entry, body)
+
+		entry.fill.mu.Lock()
+		n, err := entry.fill.n, entry.fill.err
+		entry.fill.mu.Unlock()
+		if err == nil {
+			compressedSizes.set(compressed, info, n)
+		}
+	}()
+
+	return entry, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCompressedServing(t *testing.T) {
+	dir := t.TempDir()
+
+	image := make([]byte, 100*MaxDataBlockSize+17)
+	for i := range image {
+		image[i] = byte(i * 7)
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(image)
+	w.Close()
+	os.WriteFile(filepath.Join(dir, "foo.img.gz"), gz.Bytes(), 0644)
+
+	nexus := NewFileNexus()
+	server := startServer(t, nexus)
+	local := net.IPv4(127, 0, 0, 1)
+	name := filepath.Join(dir, "foo.img")
+
+	// First time round the size isn't known until it is decompressed
+	data, oack, err := tftpGetOptions(local, server, name, map[string]string{"tsize": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image) {
+		t.Errorf("expected the uncompressed image (%d bytes); got %d bytes", len(image), len(data))
+	}
+	if oack["tsize"] != strconv.Itoa(len(image)) {
+		t.Errorf("expected tsize %d; got %q", len(image), oack["tsize"])
+	}
+
+	// Dropped from the cache, it is decompressed again with the size already known
+	nexus.Evict(name)
+	info, _ := os.Stat(filepath.Join(dir, "foo.img.gz"))
+	if size := compressedSizes.get(filepath.Join(dir, "foo.img.gz"), info); size != len(image) {
+		t.Errorf("expected cached size %d; got %d", len(image), size)
+	}
+	if data, oack, err = tftpGetOptions(local, server, name, map[string]string{"TSIZE": "0", "unknown": "1"}); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("second read: %d bytes, err %v", len(data), err)
+	}
+	if len(oack) != 1 || oack["tsize"] != strconv.Itoa(len(image)) {
+		t.Errorf("expected only tsize %d in the oack; got %v", len(image), oack)
+	}
+
+	// Corrupt input is an error, not a short file
+	os.WriteFile(filepath.Join(dir, "bad.img.gz"), gz.Bytes()[:gz.Len()/2], 0644)
+	if _, err := tftpGet(server, filepath.Join(dir, "bad.img")); err == nil {
+		t.Errorf("expected an error for a truncated .gz")
+	}
+
+	// zstd goes through the zstd command
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	raw := filepath.Join(dir, "bar.img")
+	os.WriteFile(raw, image, 0644)
+	if out, err := exec.Command("zstd", "-q", "--rm", raw).CombinedOutput(); err != nil {
+		t.Fatalf("zstd: %s %s", err, out)
+	}
+	if data, err := tftpGet(server, raw); err != nil || !bytes.Equal(data, image) {
+		t.Errorf("zstd: %d bytes, err %v", len(data), err)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the bytes available to us on the filesystem holding dir, OpenBSD names the fields differently
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("diskFree(): dir:[%s] err.Error():[%s]", dir, err.Error())
+	}
+	return int64(stat.F_bavail) * int64(stat.F_bsize), nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the bytes available to us on the filesystem holding dir
+func diskFree(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("diskFree(): dir:[%s] err.Error():[%s]", dir, err.Error())
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
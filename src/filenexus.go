@@ -2,16 +2,38 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io/ioutil"
-	"net"
+	"sort"
 	"sync"
+	"time"
 )
 
+// waitForPoll is how often a reader waiting for a download checks for an abort and its deadline
+const waitForPoll = 250 * time.Millisecond
+
 // FileEntry to contain raw-bytes for file and concurency Mutex
 type FileEntry struct {
-	Bytes []byte
+	Bytes  []byte
+	digest string // SHA-256 of Bytes once loaded or saved, "" while they may change
+
+	// Set for a file fetched from a backend (see backend.go), Bytes grows while it downloads
+	fill    *entryFill
+	source  *BackendResponse // validators for revalidation
+	checked time.Time        // when the backend last said it was current
+}
+
+// entryFill tracks a download into a FileEntry, so readers can send what has arrived and wait for the rest
+type entryFill struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	n    int   // bytes in the entry so far
+	size int   // expected, -1 if unknown
+	done bool  // finished, err says how
+	err  error // nil for a complete download
 }
 
 // NewFileEntry creates the struct
@@ -25,6 +47,7 @@ func NewFileEntry() *FileEntry {
 type FileNexus struct {
 	entries        map[string]*FileEntry
 	mapAccessMutex *sync.RWMutex
+	fetches        map[string]*backendFetch // requests to a backend in flight, by key (see GetBackendEntry)
 }
 
 // NewFileNexus create a new instance of the struct
@@ -32,6 +55,7 @@ func NewFileNexus() *FileNexus {
 	return &FileNexus{
 		entries:        make(map[string]*FileEntry),
 		mapAccessMutex: new(sync.RWMutex),
+		fetches:        make(map[string]*backendFetch),
 	}
 }
 
@@ -39,13 +63,15 @@ func NewFileNexus() *FileNexus {
 func (nexus *FileNexus) makeHashKey(remoteAddr string, filename string) string {
 	// @TODO: Evaluate this, I realized remoteAddr was IP:Port, not IP.. and nether
 	// seem good. So, I went with a simpe filename
+	// NOTE: filenames are already mapped into the client's virtual root (see vroot.go), so the same name
+	// from different roots doesn't collide
 	// result := fmt.Sprintf("%s$%s", remoteAddr, filename)
 	result := filename
 	return result
 }
 
 // GetEntry will retrieve the Entry for a given filename/connection (filling the file data if not loaded)
-func (nexus *FileNexus) GetEntry(conn *net.UDPConn, remoteAddr, filename string) (*FileEntry, error) {
+func (nexus *FileNexus) GetEntry(remoteAddr, filename string) (*FileEntry, error) {
 	// since the spec denotes:
 	// "Requests should be handled concurrently, but files being written to the server must not be visible until completed"
 	// .. as a result, I'm taking this to mean that two clients can be using the file at the same time
@@ -66,8 +92,6 @@ func (nexus *FileNexus) GetEntry(conn *net.UDPConn, remoteAddr, filename string)
 	} else {
 		err := nexus.loadBytes(key, filename, false)
 		if err != nil {
-			doSendError(conn, ErrorFileNotFound, err.Error())
-			conn.Close()
 			return nil, fmt.Errorf("ErrorFileNotFound()::" + err.Error())
 		}
 		success = true
@@ -81,6 +105,145 @@ func (nexus *FileNexus) GetEntry(conn *net.UDPConn, remoteAddr, filename string)
 	return entry, nil
 }
 
+// Stats returns the number of files held, and their total size in bytes
+func (nexus *FileNexus) Stats() (int, int) {
+
+	nexus.mapAccessMutex.RLock()
+	defer nexus.mapAccessMutex.RUnlock()
+
+	// Identical files share their bytes (see dedupe), count them once
+	size := 0
+	seen := make(map[*byte]bool)
+	for _, entry := range nexus.entries {
+		if len(entry.Bytes) > 0 && !seen[&entry.Bytes[0]] {
+			seen[&entry.Bytes[0]] = true
+			size += len(entry.Bytes)
+		}
+	}
+
+	return len(nexus.entries), size
+}
+
+// CacheEntry describes a file held in the FileNexus
+type CacheEntry struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// List returns every file held, sorted by name
+func (nexus *FileNexus) List() []CacheEntry {
+
+	nexus.mapAccessMutex.RLock()
+	defer nexus.mapAccessMutex.RUnlock()
+
+	list := make([]CacheEntry, 0, len(nexus.entries))
+	for key, entry := range nexus.entries {
+		list = append(list, CacheEntry{Name: key, Size: len(entry.Bytes)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Evict drops a file from the FileNexus, it is re-loaded on next request. False if it wasn't held.
+func (nexus *FileNexus) Evict(key string) bool {
+
+	nexus.mapAccessMutex.Lock()
+	defer nexus.mapAccessMutex.Unlock()
+
+	if _, ok := nexus.entries[key]; !ok {
+		return false
+	}
+	delete(nexus.entries, key)
+
+	return true
+}
+
+// waitFor returns the entry's bytes once there are at least end of them, or the download is over; it returns
+// straight away for a file that isn't downloading, the error is from a download that failed, or says the wait was
+// given up: no bytes for backendIdleTimeout, or t (nil for none) aborted
+func (nexus *FileNexus) waitFor(t *Transfer, entry *FileEntry, end int) ([]byte, error) {
+
+	if f := entry.fill; f != nil {
+		f.mu.Lock()
+		if f.n < end && !f.done {
+			// New bytes wake the wait, and so does this every waitForPoll, to look at the clock and for an abort
+			wake := time.NewTicker(waitForPoll)
+			stop := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-wake.C:
+						f.mu.Lock()
+						f.cond.Broadcast()
+						f.mu.Unlock()
+					}
+				}
+			}()
+			defer func() {
+				wake.Stop()
+				close(stop)
+			}()
+		}
+		last, deadline := f.n, time.Now().Add(backendIdleTimeout)
+		for f.n < end && !f.done {
+			if t != nil && t.Aborted() {
+				f.mu.Unlock()
+				return nil, fmt.Errorf("FileNexus.waitFor(): transfer aborted by operator")
+			}
+			if f.n > last {
+				last, deadline = f.n, time.Now().Add(backendIdleTimeout)
+			} else if time.Now().After(deadline) {
+				f.mu.Unlock()
+				return nil, fmt.Errorf("FileNexus.waitFor(): nothing received for %s", backendIdleTimeout)
+			}
+			f.cond.Wait()
+		}
+		err := f.err
+		f.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nexus.mapAccessMutex.RLock()
+	defer nexus.mapAccessMutex.RUnlock()
+	return entry.Bytes, nil
+}
+
+// expectedSize is the size of the file in an entry, 0 if unknown (a download without a length)
+func (entry *FileEntry) expectedSize(data []byte) int {
+	if entry.fill != nil {
+		return max(entry.fill.size, 0)
+	}
+	return len(data)
+}
+
+// Discard drops the entry for a given filename/connection, such as a failed upload's partial data
+func (nexus *FileNexus) Discard(remoteAddr string, filename string) {
+	nexus.Evict(nexus.makeHashKey(remoteAddr, filename))
+}
+
+// dedupe points entry at the bytes of another entry with the same content, so identical files under different
+// names are held once; the caller holds the lock
+func (nexus *FileNexus) dedupe(entry *FileEntry) {
+
+	if len(entry.Bytes) == 0 || entry.fill != nil {
+		return
+	}
+	digest := sha256.Sum256(entry.Bytes)
+	entry.digest = hex.EncodeToString(digest[:])
+
+	for _, other := range nexus.entries {
+		if other != entry && other.digest == entry.digest && len(other.Bytes) == len(entry.Bytes) {
+			entry.Bytes = other.Bytes
+			return
+		}
+	}
+}
+
 func (nexus *FileNexus) saveBytes(remoteAddr string, filename string) error {
 
 	// Obtain the Mutex and Lock out other ops against Hashmap
@@ -90,13 +253,19 @@ func (nexus *FileNexus) saveBytes(remoteAddr string, filename string) error {
 	// Get the Key to the HashMap for entry
 	key := nexus.makeHashKey(remoteAddr, filename)
 
-	// Perform write to file
+	// Perform write to file (or to the content-addressed store, see cas.go)
 	if fileEntry, ok := nexus.entries[key]; ok {
 
-		err := ioutil.WriteFile(filename, fileEntry.Bytes, 0644)
+		var err error
+		if cas != nil {
+			err = cas.Save(filename, fileEntry.Bytes)
+		} else {
+			err = ioutil.WriteFile(filename, fileEntry.Bytes, 0644)
+		}
 		if err != nil {
 			return fmt.Errorf("FileNexus.saveBytes(): could not write file:[%s], err.Error():[%s]", filename, err.Error())
 		}
+		nexus.dedupe(fileEntry)
 
 	} else {
 		return fmt.Errorf("FileNexus.saveBytes(): key could not be found in hashmap, key:[%s]", key)
@@ -123,6 +292,7 @@ func (nexus *FileNexus) loadBytes(key string, filename string, obtainMutex bool)
 			nexus.entries[key] = NewFileEntry()
 			nexus.entries[key].Bytes = make([]byte, len(data))
 			copy(nexus.entries[key].Bytes, data)
+			nexus.dedupe(nexus.entries[key])
 
 		} else {
 
@@ -142,6 +312,14 @@ func (nexus *FileNexus) loadBytes(key string, filename string, obtainMutex bool)
 }
 
 func (nexus *FileNexus) md5sum(entry *FileEntry) (string, error) {
+	return nexus.hashsum(entry, md5.New())
+}
+
+func (nexus *FileNexus) sha256sum(entry *FileEntry) (string, error) {
+	return nexus.hashsum(entry, sha256.New())
+}
+
+func (nexus *FileNexus) hashsum(entry *FileEntry, hasher hash.Hash) (string, error) {
 
 	// Obtain the Mutex and Lock out other ops against Hashmap
 	// if obtainMutex {
@@ -150,10 +328,9 @@ func (nexus *FileNexus) md5sum(entry *FileEntry) (string, error) {
 	// }
 
 	if entry.Bytes == nil {
-		return "", fmt.Errorf("ERROR: md5sum()::entry.Bytes==nil")
+		return "", fmt.Errorf("ERROR: hashsum()::entry.Bytes==nil")
 	}
 
-	hasher := md5.New()
 	hasher.Write(entry.Bytes)
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons a request is dropped by the listener, used as the metrics label
+const (
+	DropInvalid     = "invalid"
+	DropRate        = "rate"
+	DropOutstanding = "outstanding"
+	DropBanned      = "banned"
+)
+
+// guardPruneSize is how many sources are tracked before idle ones are forgotten
+const guardPruneSize = 4096
+
+// guard protects the listener from request floods, it lets everything through until configured
+var guard = NewGuard(GuardConfig{})
+
+// GuardConfig are the per-source limits, zero values turn a protection off
+type GuardConfig struct {
+	RequestRate    int           // RRQ/WRQ per second, with a burst of twice that
+	MaxOutstanding int           // requests queued or in progress
+	BanStrikes     int           // file-not-found/access-violation errors within BanWindow that trigger a ban
+	BanWindow      time.Duration // how far back strikes are counted
+	BanTime        time.Duration // how long a ban lasts
+}
+
+// sourceState is what the Guard knows about one client IP
+type sourceState struct {
+	tokens      float64
+	last        time.Time
+	outstanding int
+	strikes     []time.Time
+	bannedUntil time.Time
+}
+
+// Guard rate limits, caps and bans request sources (client IPs), before a socket or worker is spent on them
+type Guard struct {
+	config GuardConfig
+
+	mu      sync.Mutex
+	sources map[string]*sourceState
+}
+
+// NewGuard creates the struct
+func NewGuard(config GuardConfig) *Guard {
+	return &Guard{config: config, sources: make(map[string]*sourceState)}
+}
+
+// source returns the state for ip, creating it if need be, call with mu held
+func (g *Guard) source(ip net.IP, now time.Time) *sourceState {
+
+	key := ip.String()
+	src, ok := g.sources[key]
+	if !ok {
+		if len(g.sources) >= guardPruneSize {
+			g.prune(now)
+		}
+		src = &sourceState{tokens: float64(2 * g.config.RequestRate), last: now}
+		g.sources[key] = src
+	}
+	return src
+}
+
+// prune forgets sources with nothing outstanding, no ban and no recent strikes, call with mu held
+func (g *Guard) prune(now time.Time) {
+	for key, src := range g.sources {
+		recentStrike := len(src.strikes) > 0 && now.Sub(src.strikes[len(src.strikes)-1]) < g.config.BanWindow
+		if src.outstanding == 0 && now.After(src.bannedUntil) && !recentStrike {
+			delete(g.sources, key)
+		}
+	}
+}
+
+// Admit decides if a request from ip should be handled, if so it counts as outstanding until Release.
+// When it shouldn't, the reason is returned for the caller to count.
+func (g *Guard) Admit(ip net.IP) (bool, string) {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	src := g.source(ip, now)
+
+	if now.Before(src.bannedUntil) {
+		return false, DropBanned
+	}
+
+	if g.config.RequestRate > 0 {
+		rate := float64(g.config.RequestRate)
+		src.tokens += now.Sub(src.last).Seconds() * rate
+		if src.tokens > 2*rate {
+			src.tokens = 2 * rate
+		}
+		src.last = now
+		if src.tokens < 1 {
+			return false, DropRate
+		}
+		src.tokens--
+	}
+
+	if g.config.MaxOutstanding > 0 && src.outstanding >= g.config.MaxOutstanding {
+		return false, DropOutstanding
+	}
+
+	src.outstanding++
+	return true, ""
+}
+
+// Release is called when an admitted request is done with
+func (g *Guard) Release(ip net.IP) {
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if src, ok := g.sources[ip.String()]; ok && src.outstanding > 0 {
+		src.outstanding--
+	}
+}
+
+// Strike records a request from ip that hit a missing file or access violation, banning the source once
+// there have been BanStrikes of them within BanWindow. True if this strike got it banned.
+func (g *Guard) Strike(ip net.IP) bool {
+
+	if g.config.BanStrikes <= 0 {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	src := g.source(ip, now)
+
+	// Forget strikes that have left the window
+	recent := src.strikes[:0]
+	for _, strike := range src.strikes {
+		if now.Sub(strike) < g.config.BanWindow {
+			recent = append(recent, strike)
+		}
+	}
+	src.strikes = append(recent, now)
+
+	if len(src.strikes) >= g.config.BanStrikes {
+		src.bannedUntil = now.Add(g.config.BanTime)
+		src.strikes = nil
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 1)
+	other := net.IPv4(10, 0, 0, 2)
+
+	// Rate: a burst of twice the rate, then dropped
+	g := NewGuard(GuardConfig{RequestRate: 2})
+	for i := 0; i < 4; i++ {
+		if ok, reason := g.Admit(ip); !ok {
+			t.Fatalf("rate: request %d dropped (%s) within burst", i, reason)
+		}
+	}
+	if ok, reason := g.Admit(ip); ok || reason != DropRate {
+		t.Errorf("rate: expected drop for %s; got ok:%v reason:%s", DropRate, ok, reason)
+	}
+	if ok, _ := g.Admit(other); !ok {
+		t.Errorf("rate: other source should not share the limit")
+	}
+
+	// Outstanding: capped until released
+	g = NewGuard(GuardConfig{MaxOutstanding: 2})
+	g.Admit(ip)
+	g.Admit(ip)
+	if ok, reason := g.Admit(ip); ok || reason != DropOutstanding {
+		t.Errorf("outstanding: expected drop for %s; got ok:%v reason:%s", DropOutstanding, ok, reason)
+	}
+	g.Release(ip)
+	if ok, _ := g.Admit(ip); !ok {
+		t.Errorf("outstanding: expected admit after release")
+	}
+
+	// Ban: strikes within the window, lifted after BanTime
+	g = NewGuard(GuardConfig{BanStrikes: 3, BanWindow: time.Minute, BanTime: 50 * time.Millisecond})
+	if g.Strike(ip) || g.Strike(ip) {
+		t.Errorf("ban: banned before reaching strikes")
+	}
+	if !g.Strike(ip) {
+		t.Errorf("ban: expected ban on 3rd strike")
+	}
+	if ok, reason := g.Admit(ip); ok || reason != DropBanned {
+		t.Errorf("ban: expected drop for %s; got ok:%v reason:%s", DropBanned, ok, reason)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := g.Admit(ip); !ok {
+		t.Errorf("ban: expected admit once ban expired")
+	}
+}
+
+func TestListenerDropsStrayPackets(t *testing.T) {
+	server := startServer(t, NewFileNexus())
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	before := metricsDropped(DropInvalid)
+	for _, packet := range [][]byte{
+		(&PacketAck{1}).Serialize(),
+		(&PacketData{1, []byte("stray")}).Serialize(),
+		[]byte("\x00\x09junk"),
+		[]byte("\x01"),
+	} {
+		client.WriteToUDP(packet, server)
+	}
+
+	// Nothing comes back
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(make([]byte, MaxPacketSize)); !isTimeout(err) {
+		t.Errorf("expected no reply to stray packets; got err:%v", err)
+	}
+	if dropped := metricsDropped(DropInvalid) - before; dropped != 4 {
+		t.Errorf("expected 4 packets dropped as %s; got %d", DropInvalid, dropped)
+	}
+}
+
+func metricsDropped(reason string) uint64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.dropped[reason]
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook events, in the life of a transfer
+const (
+	EventRequest   = "request"   // RRQ/WRQ received
+	EventCompleted = "completed" // the last block has moved (and an upload is saved)
+	EventFailed    = "failed"    // refused, timed out, aborted, ...
+)
+
+// hookTimeout bounds each command, POST or socket write
+const hookTimeout = 10 * time.Second
+
+// hookWorkers run hooks, so at most this many commands or requests are in flight; hookQueue events wait for one,
+// any more are dropped
+const (
+	hookWorkers = 4
+	hookQueue   = 256
+)
+
+// hooks run on transfer events, nil when none are configured
+var hooks *Hooks
+
+// HookEvent is what a hook is told, as JSON on a command's stdin, in a webhook POST or a line on a unix socket
+type HookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Transfer  uint64    `json:"transfer"`
+	Client    string    `json:"client"`
+	File      string    `json:"file"` // the path on disk, an upload may be saved under another name (see --overwrite)
+	Direction string    `json:"direction"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Outcome   string    `json:"outcome,omitempty"`
+	ErrorCode *int      `json:"error_code,omitempty"`
+
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// Hook is one command, webhook URL or unix socket, for one event (or all of them)
+type Hook struct {
+	Event  string // "*" for every event
+	Target string
+}
+
+// Hooks fires events at hooks in the background, so a slow hook never holds up a transfer
+type Hooks struct {
+	hooks []Hook
+	queue chan hookRun
+}
+
+// hookRun is an event waiting for a worker to send it to a hook
+type hookRun struct {
+	hook Hook
+	ev   HookEvent
+}
+
+// NewHooks creates the struct, and starts its workers
+func NewHooks(list []Hook) *Hooks {
+
+	h := &Hooks{hooks: list, queue: make(chan hookRun, hookQueue)}
+	for i := 0; i < hookWorkers; i++ {
+		go h.work()
+	}
+
+	return h
+}
+
+// work runs queued hooks, one at a time
+func (h *Hooks) work() {
+	for run := range h.queue {
+		if err := run.hook.Run(run.ev); err != nil {
+			logger.Error("hook: failed", "event", run.ev.Event, "hook", run.hook.Target, "transfer", run.ev.Transfer, "err", err)
+		}
+	}
+}
+
+// Fire queues every hook for the event, for a transfer; with the queue full the event is dropped for that hook
+func (h *Hooks) Fire(event string, t *Transfer) {
+
+	if h == nil {
+		return
+	}
+
+	ev := HookEvent{
+		Event:     event,
+		Time:      time.Now().UTC(),
+		Transfer:  t.ID,
+		Client:    t.Client.String(),
+		File:      t.Path,
+		Direction: t.Direction,
+	}
+	if event != EventRequest {
+		ev.Size = t.Bytes
+		ev.SHA256 = t.SHA256
+		ev.Outcome = t.Outcome()
+		ev.Quarantined = t.Quarantined
+		if t.ErrorCode >= 0 {
+			code := t.ErrorCode
+			ev.ErrorCode = &code
+		}
+	}
+
+	for _, hook := range h.hooks {
+		if hook.Event != event && hook.Event != "*" {
+			continue
+		}
+		select {
+		case h.queue <- hookRun{hook: hook, ev: ev}:
+		default:
+			metrics.HooksDropped.Add(1)
+			logger.Warn("hook: queue full, event dropped", "event", event, "hook", hook.Target, "transfer", t.ID)
+		}
+	}
+}
+
+// Run sends the event to the hook: http(s):// URLs get a POST, unix:path a line, anything else is a command
+func (hook Hook) Run(ev HookEvent) error {
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	switch {
+	case strings.HasPrefix(hook.Target, "http://") || strings.HasPrefix(hook.Target, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("Hook.Run(): url:[%s] status:[%s]", hook.Target, resp.Status)
+		}
+
+	case strings.HasPrefix(hook.Target, "unix:"):
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "unix", strings.TrimPrefix(hook.Target, "unix:"))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(hookTimeout))
+		if _, err := conn.Write(append(body, '\n')); err != nil {
+			return err
+		}
+
+	default:
+		// Commands are split on spaces, there is no shell; the event is on stdin and in TFTP_* variables
+		args := strings.Fields(hook.Target)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"TFTP_EVENT="+ev.Event,
+			"TFTP_TRANSFER="+strconv.FormatUint(ev.Transfer, 10),
+			"TFTP_CLIENT="+ev.Client,
+			"TFTP_FILE="+ev.File,
+			"TFTP_DIRECTION="+ev.Direction,
+			"TFTP_SIZE="+strconv.Itoa(ev.Size),
+			"TFTP_SHA256="+ev.SHA256,
+			"TFTP_OUTCOME="+ev.Outcome,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Hook.Run(): cmd:[%s] err.Error():[%s] output:[%s]", hook.Target, err.Error(), strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
+
+// ParseHooks parses "event=target" pairs, as given to --hook
+func ParseHooks(specs []string) ([]Hook, error) {
+
+	var result []Hook
+	for _, spec := range specs {
+		event, target, ok := strings.Cut(spec, "=")
+		switch {
+		case !ok || strings.TrimSpace(target) == "":
+			return nil, fmt.Errorf("ParseHooks(): expected event=command|url|unix:path, got:[%s]", spec)
+		case event != EventRequest && event != EventCompleted && event != EventFailed && event != "*":
+			return nil, fmt.Errorf("ParseHooks(): expected event %s, %s, %s or *, got:[%s]", EventRequest, EventCompleted, EventFailed, event)
+		}
+		result = append(result, Hook{Event: event, Target: target})
+	}
+
+	return result, nil
+}
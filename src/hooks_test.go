@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("a crash dump")
+
+	// Webhook stub
+	posted := make(chan HookEvent, 10)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev HookEvent
+		json.NewDecoder(r.Body).Decode(&ev)
+		posted <- ev
+	}))
+	defer stub.Close()
+
+	// Unix socket
+	socketPath := filepath.Join(dir, "hooks.sock")
+	socket, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	lines := make(chan HookEvent, 10)
+	go func() {
+		for {
+			conn, err := socket.Accept()
+			if err != nil {
+				return
+			}
+			var ev HookEvent
+			json.Unmarshal([]byte(readLine(conn)), &ev)
+			lines <- ev
+			conn.Close()
+		}
+	}()
+
+	// Command, keeping what it was told
+	script := filepath.Join(dir, "hook.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$TFTP_EVENT $TFTP_SIZE\" > \"$1\"\n"), 0755)
+	commandOut := filepath.Join(dir, "command.out")
+
+	t.Cleanup(func() { hooks = nil })
+	hooks = NewHooks([]Hook{
+		{Event: "*", Target: stub.URL},
+		{Event: EventFailed, Target: "unix:" + socketPath},
+		{Event: EventCompleted, Target: script + " " + commandOut},
+	})
+	server := startServer(t, NewFileNexus())
+
+	filename := filepath.Join(dir, "core")
+	if err := tftpPut(server, filename, data); err != nil {
+		t.Fatal(err)
+	}
+	tftpGet(server, filepath.Join(dir, "missing"))
+
+	// Webhook: every event (hooks run in the background, in no particular order)
+	seen := map[string]HookEvent{}
+	for len(seen) < 4 {
+		select {
+		case ev := <-posted:
+			seen[ev.Event+" "+filepath.Base(ev.File)] = ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook: expected 4 events; got %+v", seen)
+		}
+	}
+	if ev, ok := seen["completed core"]; !ok || ev.Size != len(data) || ev.SHA256 == "" || ev.Client == "" {
+		t.Errorf("webhook: expected completed event with size, sha256 and client; got %+v", seen)
+	}
+	for _, key := range []string{"request core", "request missing", "failed missing"} {
+		if _, ok := seen[key]; !ok {
+			t.Errorf("webhook: expected %q event; got %+v", key, seen)
+		}
+	}
+
+	// Unix socket: only the failure
+	select {
+	case ev := <-lines:
+		if ev.Event != EventFailed || filepath.Base(ev.File) != "missing" || ev.ErrorCode == nil || *ev.ErrorCode != int(ErrorFileNotFound) {
+			t.Errorf("unix socket: expected failed event for missing; got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("unix socket: no event")
+	}
+
+	// Command: only the completion
+	var out []byte
+	for deadline := time.Now().Add(5 * time.Second); len(out) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		out, _ = os.ReadFile(commandOut)
+	}
+	if string(out) != "completed 12\n" {
+		t.Errorf("command: expected %q; got %q", "completed 12\n", out)
+	}
+}
+
+func readLine(conn net.Conn) string {
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	return line
+}
+
+func TestHooksQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var served atomic.Int64
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		served.Add(1)
+	}))
+	defer stub.Close()
+
+	// The workers are held up by the stub, the queue fills, and whatever doesn't fit is dropped
+	h := NewHooks([]Hook{{Event: "*", Target: stub.URL}})
+	transfer := &Transfer{Client: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, Direction: DirectionRead}
+	before := metrics.HooksDropped.Load()
+	for i := 0; i < hookWorkers; i++ {
+		h.Fire(EventRequest, transfer)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(h.queue) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < hookQueue+10; i++ {
+		h.Fire(EventRequest, transfer)
+	}
+	if dropped := metrics.HooksDropped.Load() - before; dropped != 10 {
+		t.Errorf("expected 10 events dropped; got %d", dropped)
+	}
+
+	// The queued events still go out, before the stub goes away
+	close(release)
+	for deadline := time.Now().Add(10 * time.Second); served.Load() < hookWorkers+hookQueue && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := served.Load(); n != hookWorkers+hookQueue {
+		t.Errorf("expected %d events sent; got %d", hookWorkers+hookQueue, n)
+	}
+}
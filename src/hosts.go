@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCheckEvery is how often the host table and lease file are checked for changes, at most
+const hostCheckEvery = time.Second
+
+// hostTable picks the file each client gets for a requested name, nil when there is no table
+var hostTable *HostTable
+
+// HostEntry is one "key name file" line of the host table: the client is a MAC, IP, hostname or architecture
+// (all unset for the default "*"), and name the requested filename ("*" for any)
+type HostEntry struct {
+	MAC    net.HardwareAddr
+	IP     net.IP
+	Host   string
+	Arches []uint16
+	Name   string
+	File   string
+}
+
+// HostLease is what a lease file says about an IP address
+type HostLease struct {
+	MAC     net.HardwareAddr
+	Host    string
+	Expires time.Time // zero for a lease that doesn't expire
+}
+
+// HostTable chooses the file to serve for a requested name by who the client is: its MAC, then its IP, then its
+// hostname, then its architecture, then the default. The MAC and hostname of an IP come from a lease file, or
+// from the proxyDHCP responder; its architecture only from the responder. Both files are reloaded when they change.
+type HostTable struct {
+	Path      string
+	LeasePath string // "" for none
+
+	mu        sync.Mutex
+	entries   []HostEntry
+	leases    map[string]HostLease
+	tableInfo os.FileInfo
+	leaseInfo os.FileInfo
+	checked   time.Time
+}
+
+// LoadHostTable reads a host table, and the lease file if there is one
+func LoadHostTable(path string, leasePath string) (*HostTable, error) {
+
+	h := &HostTable{Path: path, LeasePath: leasePath, checked: time.Now()}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// load reads whichever of the files changed since they were last read, the caller holds the lock unless h is new
+func (h *HostTable) load() error {
+
+	info, err := os.Stat(h.Path)
+	if err != nil {
+		return fmt.Errorf("HostTable.load(): path:[%s] err.Error():[%s]", h.Path, err.Error())
+	}
+	if changed(h.tableInfo, info) {
+		var entries []HostEntry
+		err := readHostFile(h.Path, func(r io.Reader) (err error) {
+			entries, err = ParseHostTable(r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		h.entries, h.tableInfo = entries, info
+	}
+
+	if h.LeasePath == "" {
+		return nil
+	}
+	info, err = os.Stat(h.LeasePath)
+	if err != nil {
+		return fmt.Errorf("HostTable.load(): path:[%s] err.Error():[%s]", h.LeasePath, err.Error())
+	}
+	if changed(h.leaseInfo, info) {
+		var leases map[string]HostLease
+		err := readHostFile(h.LeasePath, func(r io.Reader) (err error) {
+			leases, err = ParseLeases(r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		h.leases, h.leaseInfo = leases, info
+	}
+
+	return nil
+}
+
+// changed reports whether a file is not the one last read
+func changed(last os.FileInfo, info os.FileInfo) bool {
+	return last == nil || !last.ModTime().Equal(info.ModTime()) || last.Size() != info.Size()
+}
+
+// readHostFile opens path and parses it
+func readHostFile(path string, parse func(io.Reader) error) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("readHostFile(): path:[%s] err.Error():[%s]", path, err.Error())
+	}
+	defer file.Close()
+
+	if err := parse(file); err != nil {
+		return fmt.Errorf("readHostFile(): path:[%s] %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// reload checks the files for changes, at most every hostCheckEvery; a file that fails to load leaves the table
+// as it was
+func (h *HostTable) reload() {
+
+	if time.Since(h.checked) < hostCheckEvery {
+		return
+	}
+	h.checked = time.Now()
+
+	if err := h.load(); err != nil {
+		logger.Error("hosts: unable to reload, keeping the last table", "err", err)
+	}
+}
+
+// Lookup returns the file to serve client for a requested filename, false if the table has none for it
+func (h *HostTable) Lookup(filename string, client net.IP) (string, bool) {
+
+	if h == nil {
+		return "", false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reload()
+
+	// Who the client is: its lease, or what it told the proxyDHCP responder
+	lease, ok := h.leases[client.String()]
+	if ok && !lease.Expires.IsZero() && time.Now().After(lease.Expires) {
+		lease = HostLease{}
+	}
+	mac := lease.MAC
+	if mac == nil {
+		mac = proxyDHCP.MAC(client)
+	}
+	arch, hasArch := proxyDHCP.Arch(mac)
+
+	// The most specific key wins, and for the same key the requested name over "*"; then the first line
+	name := strings.TrimLeft(filename, "/")
+	file, best := "", -1
+	for _, entry := range h.entries {
+		rank := -1
+		switch {
+		case entry.MAC != nil:
+			if mac != nil && bytes.Equal(entry.MAC, mac) {
+				rank = 8
+			}
+		case entry.IP != nil:
+			if entry.IP.Equal(client) {
+				rank = 6
+			}
+		case entry.Host != "":
+			if strings.EqualFold(entry.Host, lease.Host) {
+				rank = 4
+			}
+		case entry.Arches != nil:
+			for _, a := range entry.Arches {
+				if hasArch && a == arch {
+					rank = 2
+				}
+			}
+		default:
+			rank = 0
+		}
+		if rank < 0 {
+			continue
+		}
+		if entry.Name == name {
+			rank++
+		} else if entry.Name != "*" {
+			continue
+		}
+		if rank > best {
+			file, best = entry.File, rank
+		}
+	}
+
+	return file, best >= 0
+}
+
+// ParseHostTable parses "key name file" lines, blank lines and '#' comments skipped: the key is a MAC, an IP, an
+// architecture (bios, efi32, efi64, arm32, arm64 or an RFC4578 number), "*" for any client, or else a hostname;
+// name is the requested filename, "*" for any
+func ParseHostTable(r io.Reader) ([]HostEntry, error) {
+
+	var entries []HostEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line:[%d] expected: key name file, got:[%s]", n, line)
+		}
+		key := fields[0]
+		entry := HostEntry{Name: strings.TrimLeft(fields[1], "/"), File: fields[2]}
+		if key != "*" {
+			if mac, err := net.ParseMAC(key); err == nil {
+				entry.MAC = mac
+			} else if ip := net.ParseIP(key); ip != nil {
+				entry.IP = ip
+			} else if arches, ok := parseArch(key); ok {
+				entry.Arches = arches
+			} else {
+				entry.Host = key
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// ParseLeases parses a lease file by IP: dnsmasq's ("expiry mac ip hostname client-id" lines, expiry 0 for
+// never) or ISC dhcpd's ("lease ip { ... }" blocks, the last one for an IP wins)
+func ParseLeases(r io.Reader) (map[string]HostLease, error) {
+
+	leases := make(map[string]HostLease)
+	var block string // the IP of the ISC lease being read, "" outside one
+	var lease HostLease
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		if len(fields) == 0 {
+			continue // a lone ";"
+		}
+
+		// ISC dhcpd
+		if fields[0] == "lease" {
+			if len(fields) != 3 || fields[2] != "{" || net.ParseIP(fields[1]) == nil {
+				return nil, fmt.Errorf("line:[%d] expected: lease ip {, got:[%s]", n, line)
+			}
+			block, lease = net.ParseIP(fields[1]).String(), HostLease{}
+			continue
+		}
+		if block != "" {
+			switch {
+			case fields[0] == "}":
+				leases[block] = lease
+				block = ""
+			case len(fields) == 3 && fields[0] == "hardware" && fields[1] == "ethernet":
+				lease.MAC, _ = net.ParseMAC(fields[2])
+			case len(fields) == 2 && fields[0] == "client-hostname":
+				lease.Host = strings.Trim(fields[1], `"`)
+			case len(fields) == 4 && fields[0] == "ends":
+				lease.Expires, _ = time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			}
+			continue
+		}
+
+		// dnsmasq, its lines start with the expiry; anything else ("duid", ISC dhcpd's other statements) is skipped
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) < 4 || net.ParseIP(fields[2]) == nil {
+			return nil, fmt.Errorf("line:[%d] expected: expiry mac ip hostname, got:[%s]", n, line)
+		}
+		lease = HostLease{}
+		lease.MAC, _ = net.ParseMAC(fields[1])
+		if fields[3] != "*" {
+			lease.Host = fields[3]
+		}
+		if expiry != 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+		leases[net.ParseIP(fields[2]).String()] = lease
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
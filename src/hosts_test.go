@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLeases(t *testing.T) {
+	dnsmasq := `duid 00:01:00:01:2c:1f:3a:10:52:54:00:00:00:ff
+0 52:54:00:12:34:56 10.0.0.7 board7 01:52:54:00:12:34:56
+1700000000 52:54:00:00:00:08 10.0.0.8 * *
+`
+	leases, err := ParseLeases(strings.NewReader(dnsmasq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := leases["10.0.0.7"]; l.MAC.String() != "52:54:00:12:34:56" || l.Host != "board7" || !l.Expires.IsZero() {
+		t.Errorf("10.0.0.7: unexpected lease %+v", l)
+	}
+	if l := leases["10.0.0.8"]; l.Host != "" || !l.Expires.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("10.0.0.8: unexpected lease %+v", l)
+	}
+
+	isc := `authoring-byte-order little-endian;
+lease 10.0.0.9 {
+  starts 4 2026/10/15 10:00:00;
+  ends 4 2026/10/15 22:00:00;
+  hardware ethernet 52:54:00:00:00:01;
+}
+lease 10.0.0.9 {
+  ends never;
+  hardware ethernet 52:54:00:00:00:09;
+  client-hostname "board9";
+}
+`
+	leases, err = ParseLeases(strings.NewReader(isc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := leases["10.0.0.9"]; l.MAC.String() != "52:54:00:00:00:09" || l.Host != "board9" || !l.Expires.IsZero() {
+		t.Errorf("10.0.0.9: expected the last lease; got %+v", l)
+	}
+
+	// Empty statements are skipped, inside a lease or out
+	leases, err = ParseLeases(strings.NewReader("lease 10.0.0.5 {\n  ;\n  client-hostname \"board5\";\n}\n;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := leases["10.0.0.5"]; l.Host != "board5" {
+		t.Errorf("10.0.0.5: unexpected lease %+v", l)
+	}
+
+	for _, bad := range []string{"0 52:54:00:12:34:56 board7\n", "lease 10.0.0.x {\n}\n"} {
+		if _, err := ParseLeases(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestHostTable(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"generic.0":  "generic",
+		"by-ip.0":    "by ip",
+		"by-mac.0":   "by mac",
+		"by-host.0":  "by host",
+		"by-arch.0":  "by arch",
+		"other.bin":  "other",
+		"by-host.sh": "host, any name",
+	} {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	at := func(name string) string { return filepath.Join(dir, name) }
+
+	table := filepath.Join(dir, "hosts")
+	os.WriteFile(table, []byte(strings.Join([]string{
+		"# key  name  file",
+		"127.0.0.1          pxelinux.0  " + at("by-ip.0"),
+		"52:54:00:00:00:02  pxelinux.0  " + at("by-mac.0"),
+		"board3             pxelinux.0  " + at("by-host.0"),
+		"board3             *           " + at("by-host.sh"),
+		"efi64              pxelinux.0  " + at("by-arch.0"),
+		"*                  pxelinux.0  " + at("generic.0"),
+	}, "\n")), 0644)
+	leases := filepath.Join(dir, "leases")
+	os.WriteFile(leases, []byte("0 52:54:00:00:00:02 127.0.0.2 board2 *\n0 52:54:00:00:00:03 127.0.0.3 board3 *\n"), 0644)
+
+	// 127.0.0.4 is only known to the proxyDHCP responder, as an efi64 client
+	responder := NewProxyDHCP(nil, nil)
+	req := pxeRequest(DHCPRequest, "52:54:00:00:00:04", 7)
+	responder.remember(req, net.IPv4(127, 0, 0, 4))
+
+	t.Cleanup(func() { hostTable, proxyDHCP = nil, nil })
+	var err error
+	hostTable, err = LoadHostTable(table, leases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyDHCP = responder
+	server := startServer(t, NewFileNexus())
+
+	tests := []struct {
+		client   net.IP
+		filename string
+		expected string
+	}{
+		{net.IPv4(127, 0, 0, 1), "pxelinux.0", "by ip"},
+		{net.IPv4(127, 0, 0, 2), "pxelinux.0", "by mac"},
+		{net.IPv4(127, 0, 0, 3), "/pxelinux.0", "by host"},
+		{net.IPv4(127, 0, 0, 3), "other.bin", "host, any name"},
+		{net.IPv4(127, 0, 0, 4), "pxelinux.0", "by arch"},
+		{net.IPv4(127, 0, 0, 5), "pxelinux.0", "generic"},
+		{net.IPv4(127, 0, 0, 5), at("other.bin"), "other"},
+	}
+	for _, test := range tests {
+		data, err := tftpGetFrom(test.client, server, test.filename)
+		if err != nil {
+			t.Errorf("%s %s: %s", test.client, test.filename, err)
+			continue
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s %s: expected %q; got %q", test.client, test.filename, test.expected, data)
+		}
+	}
+
+	// Reloaded once changed: 127.0.0.2 has a new MAC, and a broken table leaves the last one in place
+	os.WriteFile(leases, []byte("0 52:54:00:00:00:99 127.0.0.2 board2 *\n"), 0644)
+	os.Chtimes(leases, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	hostTable.mu.Lock()
+	hostTable.checked = time.Time{}
+	hostTable.mu.Unlock()
+	if file, _ := hostTable.Lookup("pxelinux.0", net.IPv4(127, 0, 0, 2)); file != at("generic.0") {
+		t.Errorf("expected the reloaded leases to give %s; got %s", at("generic.0"), file)
+	}
+
+	os.WriteFile(table, []byte("broken line\n"), 0644)
+	os.Chtimes(table, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	hostTable.mu.Lock()
+	hostTable.checked = time.Time{}
+	hostTable.mu.Unlock()
+	if file, _ := hostTable.Lookup("pxelinux.0", net.IPv4(127, 0, 0, 1)); file != at("by-ip.0") {
+		t.Errorf("expected the last table kept; got %s", file)
+	}
+}
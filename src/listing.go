@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// listingName is the pseudo-file listing any directory, set once at startup before Serve ("" for none);
+// "<name>" is a text listing and "<name>.json" the same in JSON
+var listingName string
+
+// ListingItem is a file (or subdirectory) in a generated listing
+type ListingItem struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+	Dir   bool      `json:"dir,omitempty"`
+}
+
+// listingEntry generates the listing filename names, of the directory it is in, when it isn't on disk; only
+// directories under the virtual root (or, without one, the working directory) are listed, and only the files a
+// client could read by name: requested (before the rewrite rules) as the listing's directory plus the file's name,
+// the rules and the virtual root have to lead back to the same file, and session (nil if the request isn't
+// authenticated) has to be allowed to read it
+func listingEntry(t *Transfer, session *authSession, root string, filename string) (*FileEntry, bool) {
+
+	base := filepath.Base(filename)
+	if listingName == "" || (base != listingName && base != listingName+".json") || fileExists(filename) {
+		return nil, false
+	}
+	dir := filepath.Dir(filename)
+	if !listable(root, dir) {
+		t.Info("listing refused, outside the serve root", "dir", dir)
+		return nil, false
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+
+	requestedDir := path.Dir(strings.ReplaceAll(t.Filename, "\\", "/"))
+	nameDir := path.Dir(t.Name)
+	items := []ListingItem{}
+	for _, file := range files {
+		target, err := rewriter.Rewrite(path.Join(requestedDir, file.Name()), t.Client.IP, OpRRQ)
+		if err != nil || filepath.Clean(underRoot(root, target)) != filepath.Join(dir, file.Name()) {
+			continue
+		}
+		if authKeys.Authorize(session, OpRRQ, path.Join(nameDir, file.Name())) != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		items = append(items, ListingItem{Name: file.Name(), Size: info.Size(), MTime: info.ModTime().UTC(), Dir: info.IsDir()})
+	}
+
+	listing := NewFileEntry()
+	if base == listingName {
+		var b strings.Builder
+		for _, item := range items {
+			if item.Dir {
+				fmt.Fprintf(&b, "%s  %12s  %s/\n", item.MTime.Format(time.RFC3339), "-", item.Name)
+			} else {
+				fmt.Fprintf(&b, "%s  %12d  %s\n", item.MTime.Format(time.RFC3339), item.Size, item.Name)
+			}
+		}
+		listing.Bytes = []byte(b.String())
+	} else {
+		listing.Bytes, _ = json.Marshal(items)
+		listing.Bytes = append(listing.Bytes, '\n')
+	}
+
+	return listing, true
+}
+
+// listable reports whether dir is under root, or the working directory when there is no root
+func listable(root string, dir string) bool {
+
+	var err error
+	if root == "" {
+		if root, err = os.Getwd(); err != nil {
+			return false
+		}
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ParseListingName checks the name given to --listing is a plain file name, not a path
+func ParseListingName(name string) (string, error) {
+	if strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return "", fmt.Errorf("ParseListingName(): expected a file name, got:[%s]", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pxelinux.0"), []byte("boot me"), 0644)
+	os.WriteFile(filepath.Join(dir, "secret.key"), []byte("hidden"), 0600)
+	os.Mkdir(filepath.Join(dir, "images"), 0755)
+
+	t.Cleanup(func() { listingName, rewriter, vroots = "", nil, nil })
+	listingName = ".listing"
+	rewriter, _ = ParseRewriter(strings.NewReader(`a \.key$`))
+	vroots = NewVirtualRoots([]VirtualRoot{{Dir: dir}})
+	server := startServer(t, NewFileNexus())
+
+	// Text: the files a client could read, not those the rules deny
+	data, err := tftpGet(server, "/.listing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " images/") || !strings.HasSuffix(lines[1], "       7  pxelinux.0") {
+		t.Errorf("unexpected listing:\n%s", data)
+	}
+
+	// JSON
+	data, err = tftpGet(server, ".listing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []ListingItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if len(items) != 2 || items[1].Name != "pxelinux.0" || items[1].Size != 7 || items[1].MTime.IsZero() || !items[0].Dir {
+		t.Errorf("unexpected listing: %s", data)
+	}
+
+	// An empty directory lists nothing, a missing one is File Not Found
+	if data, err := tftpGet(server, "images/.listing"); err != nil || len(data) != 0 {
+		t.Errorf("empty directory: %q, err %v", data, err)
+	}
+	if _, err := tftpGet(server, "missing/.listing"); err == nil || !strings.Contains(err.Error(), "code:[1]") {
+		t.Errorf("missing directory: expected ErrorFileNotFound; got %v", err)
+	}
+
+	// The listing is only a name under the root: ".." doesn't climb out
+	if data, err := tftpGet(server, "../../.listing"); err != nil || !strings.Contains(string(data), "pxelinux.0") {
+		t.Errorf("climbing out: expected the root's listing; got %q, err %v", data, err)
+	}
+}
+
+func TestListingOutsideRoot(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "private.key"), []byte("hidden"), 0600)
+
+	t.Cleanup(func() { listingName = "" })
+	listingName = ".listing"
+	server := startServer(t, NewFileNexus())
+
+	// Without a root, only the working directory (and below) is listed, whatever the path asked for
+	for _, name := range []string{filepath.Join(outside, ".listing"), "/etc/.listing", "../.listing"} {
+		if data, err := tftpGet(server, name); err == nil || !strings.Contains(err.Error(), "code:[1]") {
+			t.Errorf("%s: expected ErrorFileNotFound; got %q, err %v", name, data, err)
+		}
+	}
+	if data, err := tftpGet(server, ".listing"); err != nil || !strings.Contains(string(data), "listing.go") {
+		t.Errorf("working directory: expected its listing; got %q, err %v", data, err)
+	}
+}
+
+func TestListingAuthorized(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pxelinux.0"), []byte("boot me"), 0644)
+	os.WriteFile(filepath.Join(dir, "secret.img"), []byte("hidden"), 0644)
+	os.Mkdir(filepath.Join(dir, "images"), 0755)
+
+	// A key limited to some paths only sees those in a listing
+	ci := []byte("0123456789abcdef-ci")
+	t.Cleanup(func() { listingName, authKeys, vroots = "", nil, nil })
+	listingName = ".listing"
+	authKeys = NewAuthKeys([]AuthKey{{ID: "ci", Secret: ci, Read: true, Paths: []string{".listing", "*.0"}}}, false)
+	vroots = NewVirtualRoots([]VirtualRoot{{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, Dir: dir}})
+	server := startServer(t, NewFileNexus())
+
+	options := authOptions("ci", ci, "RRQ", "/.listing", "00000000000000000001", "")
+	data, _, err := tftpGetOptions(net.IPv4(127, 0, 0, 1), server, "/.listing", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], "pxelinux.0") {
+		t.Errorf("expected only pxelinux.0 listed; got:\n%s", data)
+	}
+
+	// Without a key, everything readable is listed as before
+	if data, err := tftpGet(server, "/.listing"); err != nil || !strings.Contains(string(data), "secret.img") {
+		t.Errorf("unauthenticated: expected the whole directory; got %q, err %v", data, err)
+	}
+}
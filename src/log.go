@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// logger is the structured logger used by the whole server, see InitLogging
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// InitLogging sets up the structured logger: level is one of debug/info/warn/error, format is logfmt or json.
+// Clients with their IP in debugClients are logged at debug level, regardless of level.
+func InitLogging(w io.Writer, level string, format string, debugClients []string) error {
+
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("InitLogging(): unknown log-level:[%s]", level)
+	}
+
+	// The inner handler lets everything through, filtering is done by clientLevelHandler
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var inner slog.Handler
+	switch strings.ToLower(format) {
+	case "logfmt", "text":
+		inner = slog.NewTextHandler(w, opts)
+	case "json":
+		inner = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("InitLogging(): unknown log-format:[%s]", format)
+	}
+
+	handler := &clientLevelHandler{inner: inner, level: minLevel, debugClients: map[string]bool{}}
+	for _, ip := range debugClients {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			handler.debugClients[parsed.String()] = true
+		} else {
+			return fmt.Errorf("InitLogging(): debug-client:[%s] is not an IP", ip)
+		}
+	}
+
+	logger = slog.New(handler)
+	return nil
+}
+
+// clientLevelHandler filters by level, except loggers bound to a "client" in debugClients, which get everything
+type clientLevelHandler struct {
+	inner        slog.Handler
+	level        slog.Level
+	debugClients map[string]bool
+	debug        bool
+}
+
+func (h *clientLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.debug || level >= h.level
+}
+
+func (h *clientLevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *clientLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithAttrs(attrs)
+	for _, attr := range attrs {
+		if attr.Key == "client" && h.debugClients[clientIP(attr.Value.String())] {
+			clone.debug = true
+		}
+	}
+	return &clone
+}
+
+func (h *clientLevelHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithGroup(name)
+	return &clone
+}
+
+// clientIP strips the port from a client's "ip:port"
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
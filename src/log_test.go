@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientDebugLogging(t *testing.T) {
+	var buf bytes.Buffer
+	if err := InitLogging(&buf, "info", "json", []string{"10.0.0.7"}); err != nil {
+		t.Fatal(err)
+	}
+
+	quiet := NewTransfer(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 8), Port: 1234}, DirectionRead, "quiet.bin")
+	quiet.Debug("quiet debug")
+	quiet.Info("quiet info")
+	quiet.Finish()
+
+	chatty := NewTransfer(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1234}, DirectionWrite, "chatty.bin")
+	chatty.Debug("chatty debug")
+	chatty.Finish()
+
+	out := buf.String()
+	if strings.Contains(out, "quiet debug") {
+		t.Errorf("debug event logged for client not in debug-client list: %s", out)
+	}
+	for _, want := range []string{`"msg":"quiet info"`, `"msg":"chatty debug"`, `"client":"10.0.0.7:1234"`, `"direction":"write"`, `"file":"chatty.bin"`, `"bytes":0`, `"duration":`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in log output: %s", want, out)
+		}
+	}
+
+	if err := InitLogging(&buf, "loud", "json", nil); err == nil {
+		t.Errorf("InitLogging() with unknown level: expected error")
+	}
+	if err := InitLogging(&buf, "info", "xml", nil); err == nil {
+		t.Errorf("InitLogging() with unknown format: expected error")
+	}
+}
@@ -3,40 +3,68 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"net"
 	"os"
+	"time"
 
 	"github.com/pborman/getopt"
 )
 
-var (
-	logInfo  *log.Logger
-	logError *log.Logger
-	logFatal *log.Logger
-	logDebug *log.Logger
-)
-
-// Init is the package init, called automagically
-func Init(logInfoH io.Writer, logErrorH io.Writer, logFatalH io.Writer, logDebugH io.Writer) {
-
-	logInfo = log.New(logInfoH, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	logError = log.New(logErrorH, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	logFatal = log.New(logFatalH, "FATAL: ", log.Ldate|log.Ltime|log.Lshortfile)
-	logDebug = log.New(logDebugH, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-
-}
-
 func main() {
 
-	// Logging: Setup
-	Init(os.Stdout, os.Stderr, ioutil.Discard, ioutil.Discard)
-
 	// Cmd-line Parameters
 	optIP := getopt.StringLong("ip", 'i', "127.0.0.1", "Listener IP")
 	optPort := getopt.IntLong("port", 'p', 69, "Listener Port")
 	optThreads := getopt.IntLong("threads", 't', 16, "Max Threads")
 	optTimeout := getopt.IntLong("timeout", 'o', 1, "Timeout (sec)")
+	optFD := getopt.IntLong("fd", 0, -1, "Inherited Listener FD")
+	optUser := getopt.StringLong("user", 'u', "", "Run as User")
+	optGroup := getopt.StringLong("group", 'g', "", "Run as Group")
+	optChroot := getopt.StringLong("chroot", 0, "", "Chroot Directory")
+	optLogLevel := getopt.StringLong("log-level", 0, "info", "Log Level (debug|info|warn|error)")
+	optLogFormat := getopt.StringLong("log-format", 0, "logfmt", "Log Format (logfmt|json)")
+	optDebugClients := getopt.ListLong("debug-client", 0, "Debug Logging for Client IP(s)")
+	optMetrics := getopt.StringLong("metrics", 0, "", "Metrics Listener ip:port (/metrics)")
+	optAuditLog := getopt.StringLong("audit-log", 0, "", "Audit Log File (JSON lines)")
+	optAuditMaxSize := getopt.IntLong("audit-max-size", 0, 100, "Audit Log Rotation Size (MB)")
+	optAuditBackups := getopt.IntLong("audit-backups", 0, 10, "Audit Log Rotated Files Kept")
+	optAdmin := getopt.StringLong("admin", 0, "", "Admin API Listener ip:port")
+	optTUI := getopt.BoolLong("tui", 0, "Live Dashboard instead of Logs (terminal only)")
+	optRateGlobal := getopt.StringLong("rate-global", 0, "0", "Rate Limit, all Transfers (bytes/sec, k/M/G)")
+	optRateClient := getopt.StringLong("rate-client", 0, "0", "Rate Limit, per Client IP (bytes/sec, k/M/G)")
+	optRateFiles := getopt.ListLong("rate-file", 0, "Rate Limit, per File glob=rate (bytes/sec, k/M/G)")
+	optReqRate := getopt.IntLong("req-rate", 0, 0, "Requests/sec per Client IP (0 is unlimited)")
+	optMaxOutstanding := getopt.IntLong("max-outstanding", 0, 0, "Requests in progress per Client IP (0 is unlimited)")
+	optBanStrikes := getopt.IntLong("ban-strikes", 0, 0, "Not Found/Access Violations that ban a Client IP (0 is never)")
+	optBanWindow := getopt.DurationLong("ban-window", 0, time.Minute, "Window for counting ban-strikes")
+	optBanTime := getopt.DurationLong("ban-time", 0, 5*time.Minute, "Ban Duration")
+	optMaxFileSize := getopt.StringLong("max-file-size", 0, "0", "Max Upload Size (bytes, k/M/G)")
+	optQuotaClient := getopt.StringLong("quota-client", 0, "0", "Upload Quota per Client IP (bytes, k/M/G)")
+	optQuotaDirs := getopt.ListLong("quota-dir", 0, "Size Quota per Directory dir=size (bytes, k/M/G)")
+	optMinFree := getopt.StringLong("min-free", 0, "0", "Free Space to Keep on Upload Filesystem (bytes, k/M/G)")
+	optOverwrite := getopt.StringLong("overwrite", 0, PolicyAllow, "WRQ to an Existing File: allow, deny-overwrite, create-versioned, timestamp-suffix")
+	optOverwriteDirs := getopt.ListLong("overwrite-dir", 0, "Overwrite Policy per Directory dir=policy")
+	optSidecars := getopt.BoolLong("sidecars", 0, "Serve Generated .md5/.sha256 Sidecars for Any File")
+	optListing := getopt.StringLong("listing", 0, "", "Serve a Generated Listing of Any Directory as this Name (and name.json)")
+	optQuarantine := getopt.StringLong("quarantine", 0, "", "Verify Uploads Against Sidecars, Moving Failures Here")
+	optHooks := getopt.ListLong("hook", 0, "Run on Transfer Events event=command|url|unix:path, event is request, completed, failed or *")
+	optRemap := getopt.StringLong("remap", 0, "", "Filename Rewrite Rules, in tftpd-hpa remap format")
+	optMapBackslash := getopt.BoolLong("map-backslash", 0, "Turn '\\' in Filenames into '/'")
+	optRoots := getopt.ListLong("root", 0, "Root Directory per Client Subnet or Local Address cidr=dir, @ip=dir, *=dir")
+	optRootBackends := getopt.ListLong("root-backend", 0, "Backend of its Own for a Root Directory dir=url|s3://bucket/prefix, Instead of --backend")
+	optBackend := getopt.StringLong("backend", 0, "", "Fetch Files Missing Locally from an http(s):// Base URL, or s3://bucket/prefix (Uploads Go There Too)")
+	optBackendRevalidate := getopt.DurationLong("backend-revalidate", 0, 0, "Serve a Fetched File this Long Before Revalidating it")
+	optMulticast := getopt.StringLong("multicast", 0, "", "Multicast (RFC2090) Reads, to Groups Taken from this IPv4 Subnet")
+	optMulticastPort := getopt.IntLong("multicast-port", 0, 1758, "Port for Multicast Groups")
+	optProxyDHCP := getopt.BoolLong("proxy-dhcp", 0, "Answer PXE Clients with the Boot File (proxyDHCP on Ports 67 and 4011)")
+	optPXEBoots := getopt.ListLong("pxe-boot", 0, "Boot File per Client MAC or Architecture mac=file, arch=file, *=file")
+	optPXEServer := getopt.StringLong("pxe-server", 0, "", "TFTP Server Handed to PXE Clients (default: the Address Asked)")
+	optHosts := getopt.StringLong("hosts", 0, "", "Host Table Choosing the File Each Client Gets for a Requested Name")
+	optLeases := getopt.StringLong("leases", 0, "", "DHCP Lease File (dnsmasq or ISC dhcpd) Giving the Host Table Each Client's MAC and Hostname")
+	optAuthKeys := getopt.StringLong("auth-keys", 0, "", "Pre-Shared Keys for Authenticated Transfers, and the Paths Each May Read/Write")
+	optAuthWrites := getopt.BoolLong("auth-writes", 0, "Refuse WRQs that aren't Authenticated")
+	optCAS := getopt.StringLong("cas", 0, "", "Store Uploads Once per SHA-256 in this Directory, Filenames Hard Linked to Them")
+	optCASGC := getopt.DurationLong("cas-gc", 0, time.Hour, "Interval for Removing Blobs no Filename Links to")
 	optHelp := getopt.BoolLong("help", 0, "Help")
 	getopt.Parse()
 	if *optHelp {
@@ -44,8 +72,282 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Dashboard: replaces the scrolling log, but only on a terminal
+	var logOut io.Writer = os.Stdout
+	var dashboard *Dashboard
+	if *optTUI && isTerminal(os.Stdout) {
+		dashboard = NewDashboard(os.Stdout)
+		logOut = dashboard
+		if *optLogLevel == "debug" || *optLogLevel == "info" {
+			*optLogLevel = "warn"
+		}
+	}
+
+	// Logging: Setup
+	err := InitLogging(logOut, *optLogLevel, *optLogFormat, *optDebugClients)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		getopt.Usage()
+		os.Exit(5)
+	}
+
+	// Rate Limits: adjustable later through the Admin API
+	limits := RateLimits{}
+	limits.Global, err = ParseByteSize(*optRateGlobal)
+	if err == nil {
+		limits.Client, err = ParseByteSize(*optRateClient)
+	}
+	if err == nil {
+		limits.Files, err = ParseFileRates(*optRateFiles)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	rateLimiter.SetLimits(limits)
+
+	// Quotas: Upload size and disk space limits
+	quotaConfig := QuotaConfig{}
+	quotaConfig.MaxFileSize, err = ParseByteSize(*optMaxFileSize)
+	if err == nil {
+		quotaConfig.ClientQuota, err = ParseByteSize(*optQuotaClient)
+	}
+	if err == nil {
+		quotaConfig.MinFree, err = ParseByteSize(*optMinFree)
+	}
+	if err == nil {
+		quotaConfig.DirQuotas, err = ParseDirQuotas(*optQuotaDirs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	quotas.SetConfig(quotaConfig)
+
+	// Write Policy: what a WRQ does to an existing file
+	policy, err := ParseWritePolicy(*optOverwrite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	dirPolicies, err := ParseDirPolicies(*optOverwriteDirs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	writePolicies.SetPolicies(policy, dirPolicies)
+
+	// Checksum Sidecars
+	sidecars = SidecarConfig{Serve: *optSidecars, Quarantine: *optQuarantine}
+
+	// Directory Listings
+	listingName, err = ParseListingName(*optListing)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+
+	// Rewrite Rules: requested filenames to files
+	if *optRemap != "" {
+		rewriter, err = LoadRewriter(*optRemap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+	}
+	if *optMapBackslash {
+		if rewriter == nil {
+			rewriter = &Rewriter{}
+		}
+		rewriter.Backslash = true
+	}
+
+	// Virtual Roots: boot trees per client subnet or local address
+	roots, err := ParseVirtualRoots(*optRoots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	if len(roots) > 0 {
+		vroots = NewVirtualRoots(roots)
+	}
+
+	// Backend: where files missing locally are fetched from
+	if *optBackend != "" {
+		backend, err = NewBackend(*optBackend)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+		backendRevalidate = *optBackendRevalidate
+	}
+	if len(*optRootBackends) > 0 {
+		if err := vroots.SetBackends(*optRootBackends); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+		backendRevalidate = *optBackendRevalidate
+	}
+
+	// Uploads to a bucket never touch the local disk, where write policies, quota directories, free space and
+	// sidecars are checked
+	if vroots.TakesUploads() && (policy != PolicyAllow || len(dirPolicies) > 0 || len(quotaConfig.DirQuotas) > 0 || quotaConfig.MinFree > 0 || *optQuarantine != "") {
+		fmt.Fprintf(os.Stderr, "backend: uploads go to the bucket, --overwrite, --overwrite-dir, --quota-dir, --min-free and --quarantine can't be used with it\n")
+		os.Exit(5)
+	}
+
+	// Multicast: groups for RFC2090 sessions
+	if *optMulticast != "" {
+		groups, err := ParseMulticastGroups(*optMulticast)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+		mcast = NewMulticast(groups, *optMulticastPort)
+	}
+
+	// ProxyDHCP: boot files for PXE clients
+	if *optProxyDHCP {
+		boots, err := ParsePXEBoots(*optPXEBoots)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+		var server net.IP
+		if *optPXEServer != "" {
+			server = net.ParseIP(*optPXEServer).To4()
+			if server == nil {
+				fmt.Fprintf(os.Stderr, "pxe-server: expected an IPv4 address, got:[%s]\n", *optPXEServer)
+				os.Exit(5)
+			}
+		}
+		proxyDHCP = NewProxyDHCP(server, boots)
+	}
+
+	// Authentication: pre-shared keys, plain requests still served unless writes need a key
+	if *optAuthKeys != "" {
+		keys, err := LoadAuthKeys(*optAuthKeys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(5)
+		}
+		authKeys = NewAuthKeys(keys, *optAuthWrites)
+	} else if *optAuthWrites {
+		fmt.Fprintf(os.Stderr, "auth-writes: needs --auth-keys\n")
+		os.Exit(5)
+	}
+
+	// Host Table: the lease file only tells it who clients are
+	if *optLeases != "" && *optHosts == "" {
+		fmt.Fprintf(os.Stderr, "leases: needs --hosts\n")
+		os.Exit(5)
+	}
+
+	// Hooks: commands, webhooks and unix sockets told about transfers
+	hookList, err := ParseHooks(*optHooks)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(5)
+	}
+	if len(hookList) > 0 {
+		hooks = NewHooks(hookList)
+	}
+
+	// Flood Protection
+	guard = NewGuard(GuardConfig{
+		RequestRate:    *optReqRate,
+		MaxOutstanding: *optMaxOutstanding,
+		BanStrikes:     *optBanStrikes,
+		BanWindow:      *optBanWindow,
+		BanTime:        *optBanTime,
+	})
+
+	// Listener: Inherited (socket activation) or our own
+	conn, err := ActivatedListener(*optFD)
+	if err != nil {
+		logger.Error("listener: unable to inherit", "err", err)
+		os.Exit(3)
+	}
+	if conn == nil {
+		serverIPPort := fmt.Sprintf("%s:%d", *optIP, *optPort)
+		conn = SetupListener(serverIPPort)
+	}
+
+	// ProxyDHCP Listeners: bound now too, port 67 needs root
+	if proxyDHCP != nil {
+		for _, port := range []int{67, 4011} {
+			dhcpConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+			if err != nil {
+				logger.Error("proxydhcp: unable to listen", "port", port, "err", err)
+				os.Exit(10)
+			}
+			go proxyDHCP.Serve(dhcpConn)
+		}
+	}
+
+	// Listener is bound, so root is no longer needed
+	err = DropPrivileges(*optUser, *optGroup, *optChroot)
+	if err != nil {
+		logger.Error("unable to drop privileges", "err", err)
+		os.Exit(4)
+	}
+
+	// Metrics: Optional Prometheus endpoint
+	if *optMetrics != "" {
+		err = ServeMetrics(*optMetrics)
+		if err != nil {
+			logger.Error("metrics: unable to listen", "err", err)
+			os.Exit(6)
+		}
+	}
+
+	// Audit: Optional record of every transfer
+	if *optAuditLog != "" {
+		audit, err = OpenAuditLog(*optAuditLog, int64(*optAuditMaxSize)*1024*1024, *optAuditBackups)
+		if err != nil {
+			logger.Error("audit: unable to open", "err", err)
+			os.Exit(7)
+		}
+	}
+
+	// Content-Addressed Store: uploads deduplicated by checksum
+	if *optCAS != "" {
+		cas, err = OpenCASStore(*optCAS)
+		if err != nil {
+			logger.Error("cas: unable to open", "err", err)
+			os.Exit(9)
+		}
+		cas.CollectEvery(*optCASGC)
+	}
+
+	// Host Table: boot files per client, reloaded when it (or the lease file) changes
+	if *optHosts != "" {
+		hostTable, err = LoadHostTable(*optHosts, *optLeases)
+		if err != nil {
+			logger.Error("hosts: unable to load", "err", err)
+			os.Exit(11)
+		}
+	}
+
+	// Central repo for File data and mutexes
+	nexus := NewFileNexus()
+
+	// Admin: Optional HTTP API for live inspection and control
+	if *optAdmin != "" {
+		err = ServeAdmin(*optAdmin, nexus)
+		if err != nil {
+			logger.Error("admin: unable to listen", "err", err)
+			os.Exit(8)
+		}
+	}
+
+	if dashboard != nil {
+		go dashboard.Run(500 * time.Millisecond)
+	} else if *optTUI {
+		logger.Warn("tui: stdout is not a terminal, logging instead")
+	}
+
 	// Server Spin-Up!
-	serverIPPort := fmt.Sprintf("%s:%d", *optIP, *optPort)
-	ListenAndServe(serverIPPort, *optThreads, *optTimeout)
+	Serve(conn, nexus, *optThreads, *optTimeout)
 
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// durationBuckets are the upper bounds (sec) of the transfer duration histogram
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// metrics is collected by the whole server, it is served by ServeMetrics (if enabled)
+var metrics = NewMetrics()
+
+// Metrics are the server's counters, gauges and histograms, written in the Prometheus text format
+type Metrics struct {
+	BytesSent       atomic.Uint64
+	BytesReceived   atomic.Uint64
+	Retransmissions atomic.Uint64
+	Timeouts        atomic.Uint64
+	ActiveTransfers atomic.Int64
+	WorkersBusy     atomic.Int64
+	HooksDropped    atomic.Uint64
+
+	mu        sync.Mutex
+	requests  map[[2]string]uint64 // [op, outcome]
+	errors    map[uint16]uint64
+	dropped   map[string]uint64
+	durations map[string]*histogram // by op
+
+	// Gauges sampled at scrape time, set by Serve
+	workers    int
+	queueDepth func() int
+	queueCap   int
+	nexus      *FileNexus
+}
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics creates the struct
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[[2]string]uint64),
+		errors:    make(map[uint16]uint64),
+		dropped:   make(map[string]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// SetWorkers records the worker pool and its channel, for saturation gauges
+func (m *Metrics) SetWorkers(workers int, dataChannel chan RawPacket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.workers = workers
+	m.queueCap = cap(dataChannel)
+	m.queueDepth = func() int { return len(dataChannel) }
+}
+
+// SetNexus records the FileNexus, for cache gauges
+func (m *Metrics) SetNexus(nexus *FileNexus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nexus = nexus
+}
+
+// ErrorSent counts an ERROR packet sent to a client
+func (m *Metrics) ErrorSent(code uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[code]++
+}
+
+// Dropped counts a packet the listener dropped without replying, by reason
+func (m *Metrics) Dropped(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[reason]++
+}
+
+// TransferDone counts a finished transfer by op and outcome, and its duration
+func (m *Metrics) TransferDone(op string, outcome string, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[2]string{op, outcome}]++
+
+	h, ok := m.durations[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[op] = h
+	}
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Outcomes returns the number of finished transfers by outcome, across ops
+func (m *Metrics) Outcomes() (completed uint64, failed uint64, rejected uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, count := range m.requests {
+		switch k[1] {
+		case OutcomeCompleted:
+			completed += count
+		case OutcomeFailed:
+			failed += count
+		case OutcomeRejected:
+			rejected += count
+		}
+	}
+	return
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+
+	var b strings.Builder
+
+	m.mu.Lock()
+
+	writeHeader(&b, "tftp_requests_total", "counter", "RRQ/WRQ handled, by op and outcome")
+	keys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+keys[i][1] < keys[j][0]+keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "tftp_requests_total{op=%q,outcome=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+
+	writeHeader(&b, "tftp_errors_sent_total", "counter", "ERROR packets sent to clients, by code")
+	codes := make([]int, 0, len(m.errors))
+	for code := range m.errors {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "tftp_errors_sent_total{code=\"%d\"} %d\n", code, m.errors[uint16(code)])
+	}
+
+	writeHeader(&b, "tftp_requests_dropped_total", "counter", "Packets dropped by the listener without reply, by reason")
+	reasons := make([]string, 0, len(m.dropped))
+	for reason := range m.dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "tftp_requests_dropped_total{reason=%q} %d\n", reason, m.dropped[reason])
+	}
+
+	writeHeader(&b, "tftp_transfer_duration_seconds", "histogram", "Duration of finished transfers, by op")
+	ops := make([]string, 0, len(m.durations))
+	for op := range m.durations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := m.durations[op]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "tftp_transfer_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, cumulative)
+		}
+		fmt.Fprintf(&b, "tftp_transfer_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(&b, "tftp_transfer_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(&b, "tftp_transfer_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+
+	workers, queueCap, queueDepth, nexus := m.workers, m.queueCap, m.queueDepth, m.nexus
+	m.mu.Unlock()
+
+	writeMetric(&b, "tftp_bytes_sent_total", "counter", "DATA payload bytes sent, including retransmissions", m.BytesSent.Load())
+	writeMetric(&b, "tftp_bytes_received_total", "counter", "DATA payload bytes received", m.BytesReceived.Load())
+	writeMetric(&b, "tftp_retransmissions_total", "counter", "DATA/ACK packets sent again", m.Retransmissions.Load())
+	writeMetric(&b, "tftp_timeouts_total", "counter", "Reads from clients that timed out", m.Timeouts.Load())
+	writeMetric(&b, "tftp_hook_events_dropped_total", "counter", "Hook events dropped as the hook queue was full", m.HooksDropped.Load())
+	writeMetric(&b, "tftp_active_transfers", "gauge", "Transfers in progress", m.ActiveTransfers.Load())
+	writeMetric(&b, "tftp_workers", "gauge", "Size of the worker pool", workers)
+	writeMetric(&b, "tftp_workers_busy", "gauge", "Workers handling a request", m.WorkersBusy.Load())
+	writeMetric(&b, "tftp_queue_capacity", "gauge", "Capacity of the request channel", queueCap)
+	if queueDepth != nil {
+		writeMetric(&b, "tftp_queue_depth", "gauge", "Requests waiting for a worker", queueDepth())
+	}
+	if nexus != nil {
+		entries, size := nexus.Stats()
+		writeMetric(&b, "tftp_cache_entries", "gauge", "Files held in the FileNexus", entries)
+		writeMetric(&b, "tftp_cache_bytes", "gauge", "Bytes held in the FileNexus", size)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(b *strings.Builder, name string, kind string, help string, value any) {
+	writeHeader(b, name, kind, help)
+	fmt.Fprintf(b, "%s %d\n", name, value)
+}
+
+// ServeMetrics binds addr and serves /metrics on it in the background
+func ServeMetrics(addr string) error {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("ServeMetrics(): addr:[%s] err.Error():[%s]", addr, err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		err := http.Serve(listener, mux)
+		logger.Error("metrics: stopped", "err", err)
+	}()
+
+	logger.Info("metrics: listening", "addr", listener.Addr().String())
+	return nil
+}
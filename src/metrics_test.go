@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+
+	dataChannel := make(chan RawPacket, 8)
+	dataChannel <- RawPacket{}
+	m.SetWorkers(4, dataChannel)
+
+	nexus := NewFileNexus()
+	nexus.entries["foo"] = &FileEntry{Bytes: []byte("fnord")}
+	m.SetNexus(nexus)
+
+	m.BytesSent.Add(1024)
+	m.Retransmissions.Add(2)
+	m.ErrorSent(ErrorFileNotFound)
+	m.ErrorSent(ErrorFileNotFound)
+	m.TransferDone("rrq", OutcomeCompleted, 0.2)
+	m.TransferDone("rrq", OutcomeCompleted, 7)
+	m.TransferDone("wrq", OutcomeRejected, 0.001)
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		`tftp_requests_total{op="rrq",outcome="completed"} 2`,
+		`tftp_requests_total{op="wrq",outcome="rejected"} 1`,
+		`tftp_errors_sent_total{code="1"} 2`,
+		`tftp_transfer_duration_seconds_bucket{op="rrq",le="0.1"} 0`,
+		`tftp_transfer_duration_seconds_bucket{op="rrq",le="0.5"} 1`,
+		`tftp_transfer_duration_seconds_bucket{op="rrq",le="10"} 2`,
+		`tftp_transfer_duration_seconds_bucket{op="rrq",le="+Inf"} 2`,
+		`tftp_transfer_duration_seconds_count{op="rrq"} 2`,
+		"tftp_bytes_sent_total 1024",
+		"tftp_retransmissions_total 2",
+		"tftp_workers 4",
+		"tftp_queue_depth 1",
+		"tftp_queue_capacity 8",
+		"tftp_cache_entries 1",
+		"tftp_cache_bytes 5",
+		"# TYPE tftp_transfer_duration_seconds histogram",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", want, out)
+		}
+	}
+}
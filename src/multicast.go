@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// mcast runs multicast (RFC2090) reads, nil when the option is ignored and every read is unicast
+var mcast *Multicast
+
+// Multicast hands out groups to sessions, one session (and group) per file being read
+type Multicast struct {
+	Groups *net.IPNet
+	Port   int
+
+	mu       sync.Mutex
+	inUse    map[string]bool
+	sessions map[string]*mcastSession
+}
+
+// NewMulticast creates the struct, groups are taken from an IPv4 multicast subnet
+func NewMulticast(groups *net.IPNet, port int) *Multicast {
+	return &Multicast{
+		Groups:   groups,
+		Port:     port,
+		inUse:    make(map[string]bool),
+		sessions: make(map[string]*mcastSession),
+	}
+}
+
+// ParseMulticastGroups parses the subnet given to --multicast, it has to be IPv4 multicast
+func ParseMulticastGroups(cidr string) (*net.IPNet, error) {
+
+	ip, groups, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("ParseMulticastGroups(): err.Error():[%s]", err.Error())
+	}
+	if ip.To4() == nil || !ip.IsMulticast() {
+		return nil, fmt.Errorf("ParseMulticastGroups(): expected an IPv4 multicast subnet, got:[%s]", cidr)
+	}
+
+	return groups, nil
+}
+
+// mcastSession sends one file to a group: the master client ACKs, the others listen in; once the master has the
+// whole file the next client in line becomes master, ACKing from the blocks it is missing
+type mcastSession struct {
+	m     *Multicast
+	key   string
+	group *net.UDPAddr
+	conn  *net.UDPConn // the server's end, clients ACK to it
+	data  []byte
+	sum   string
+	last  int // the last block (short, maybe empty)
+
+	mu      sync.Mutex
+	clients []*mcastClient // in the order they joined, the first is master
+	sent    int            // DATA sent to the group
+	highest int            // highest block sent
+}
+
+// mcastClient is a client in a session
+type mcastClient struct {
+	t        *Transfer
+	oack     map[string]string // the options it asked for other than multicast, such as tsize
+	joinedAt int               // DATA sent to the group before it joined
+}
+
+// doMulticast serves an RRQ with the multicast option: the first client for a file starts a session and runs it
+// (in this thread), later ones join it and are finished by it; false if no group is free, the file is then sent
+// unicast as usual
+func doMulticast(t *Transfer, nexus *FileNexus, entry *FileEntry, conn *net.UDPConn, packet PacketRequest, timeout int) bool {
+
+	// Every block has to be there for resends to late joiners, so wait for a download to finish
+	data, err := nexus.waitFor(t, entry, math.MaxInt)
+	if err != nil {
+		doSendError(t, ErrorNotDefined, err.Error())
+		return true
+	}
+
+	// Other options are answered as usual, except offset, which makes no sense for a group
+	requested := make(map[string]string)
+	for name, value := range packet.Options {
+		if name != "multicast" && name != "offset" {
+			requested[name] = value
+		}
+	}
+	oack, _, data, err := readOptions(t, nexus, entry, data, requested)
+	if err != nil {
+		doSendError(t, ErrorNotDefined, err.Error())
+		return true
+	}
+	t.SetSize(len(data))
+
+	client := &mcastClient{t: t, oack: oack}
+	t.detached.Store(true)
+	session, owner := mcast.join(packet.Filename, client, conn, data)
+	if session == nil {
+		t.detached.Store(false)
+		t.Info("multicast: no group free, sending unicast")
+		return false
+	}
+	if !owner {
+		return true
+	}
+
+	session.run(timeout)
+	return true
+}
+
+// join adds client to the session for key, or starts one (owner is true, the caller runs it); nil if a session
+// is needed but no group is free
+func (m *Multicast) join(key string, client *mcastClient, conn *net.UDPConn, data []byte) (*mcastSession, bool) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[key]; ok {
+		s.mu.Lock()
+		client.joinedAt = s.sent
+		s.clients = append(s.clients, client)
+		s.mu.Unlock()
+
+		client.t.Info("multicast: joined", "group", s.group.String())
+		s.conn.WriteToUDP(s.oack(client, false), client.t.Client)
+		return s, false
+	}
+
+	group := m.allocate()
+	if group == nil {
+		return nil, false
+	}
+	if local := multicastInterface(conn, client.t.Client); local != nil {
+		if err := setMulticastInterface(conn, local); err != nil {
+			logger.Warn("multicast: unable to set interface, using the default", "addr", local.String(), "err", err)
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	s := &mcastSession{
+		m:       m,
+		key:     key,
+		group:   &net.UDPAddr{IP: group, Port: m.Port},
+		conn:    conn,
+		data:    data,
+		sum:     hex.EncodeToString(sum[:]),
+		last:    len(data)/MaxDataBlockSize + 1,
+		clients: []*mcastClient{client},
+	}
+	m.sessions[key] = s
+	client.t.Info("multicast: session started", "group", s.group.String(), "blocks", s.last)
+
+	return s, true
+}
+
+// multicastInterface is the (IPv4) address of the interface to send a session's group out of: the one the request
+// came in on, or else the one facing the client; nil for the default
+func multicastInterface(conn *net.UDPConn, client *net.UDPAddr) net.IP {
+
+	if local := conn.LocalAddr().(*net.UDPAddr).IP; local.To4() != nil && !local.IsUnspecified() {
+		return local
+	}
+	return routeSource(client)
+}
+
+// allocate takes the first group not in use, nil if there is none; the caller holds the lock
+func (m *Multicast) allocate() net.IP {
+
+	for ip := m.Groups.IP.Mask(m.Groups.Mask).To4(); m.Groups.Contains(ip); ip = nextIP(ip) {
+		if !m.inUse[ip.String()] {
+			m.inUse[ip.String()] = true
+			return ip
+		}
+	}
+	return nil
+}
+
+// nextIP is the address after ip, 0.0.0.0 after 255.255.255.255
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// oack is the OACK for a client: "group,port,1" for the master, 0 for the others
+func (s *mcastSession) oack(c *mcastClient, master bool) []byte {
+
+	options := map[string]string{}
+	for name, value := range c.oack {
+		options[name] = value
+	}
+	mc := "0"
+	if master {
+		mc = "1"
+	}
+	options["multicast"] = fmt.Sprintf("%s,%d,%s", s.group.IP.String(), s.group.Port, mc)
+
+	p := PacketOAck{Options: options}
+	return p.Serialize()
+}
+
+// run sends the file to each client in turn, until there are none left; the group is then free again
+func (s *mcastSession) run(timeout int) {
+	for {
+		c := s.nextMaster()
+		if c == nil {
+			logger.Info("multicast: session over", "file", s.key, "group", s.group.String(), "sent", s.sent)
+			return
+		}
+		s.serve(c, timeout)
+	}
+}
+
+// nextMaster is the client that joined first of those not done, nil when there are none (and the session is over)
+func (s *mcastSession) nextMaster() *mcastClient {
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.clients) == 0 {
+		delete(s.m.sessions, s.key)
+		delete(s.m.inUse, s.group.IP.String())
+		return nil
+	}
+	return s.clients[0]
+}
+
+// serve makes c master and sends the blocks it ACKs for, until it has the whole file or is dropped
+func (s *mcastSession) serve(c *mcastClient, timeout int) {
+
+	// A new master answers its OACK with an ACK of the last block it has in order (0 for none)
+	c.t.Debug("multicast: master")
+	ack, ok := s.exchange(c, s.oack(c, true), c.t.Client, timeout)
+
+	for ok {
+		block := s.absolute(ack, c)
+		c.t.SetProgress(ack, min(block*MaxDataBlockSize, len(s.data)))
+		if block >= s.last {
+			c.t.Completed = true
+			c.t.SHA256 = s.sum
+			c.t.Info("success", "sha256", s.sum)
+			s.drop(c)
+			return
+		}
+
+		// Send the block after it to the group, everyone still missing it picks it up
+		block++
+		start := (block - 1) * MaxDataBlockSize
+		end := min(start+MaxDataBlockSize, len(s.data))
+		rateLimiter.Wait(c.t.Client, c.t.Name, end-start)
+		dataPacket := makePacketData(uint16(block), s.data, start, end-start)
+		metrics.BytesSent.Add(uint64(end - start))
+
+		s.mu.Lock()
+		s.sent++
+		s.highest = max(s.highest, block)
+		s.mu.Unlock()
+
+		ack, ok = s.exchange(c, dataPacket.Serialize(), s.group, timeout)
+	}
+}
+
+// absolute is the block number an ACK from c means: block numbers roll over at 65535, it is the latest with the
+// same number that c can have seen, i.e. sent to the group since it joined
+func (s *mcastSession) absolute(ack uint16, c *mcastClient) int {
+
+	s.mu.Lock()
+	limit := min(s.highest, s.sent-c.joinedAt)
+	s.mu.Unlock()
+
+	return max(limit-(limit-int(ack))&0xffff, 0)
+}
+
+// exchange sends buf to addr and waits for the master's ACK, sending it again on a timeout; false if the master
+// is gone (ERROR, abort or no answer), it has been dropped
+func (s *mcastSession) exchange(c *mcastClient, buf []byte, addr *net.UDPAddr, timeout int) (uint16, bool) {
+
+	if _, err := s.conn.WriteToUDP(buf, addr); err != nil {
+		s.fail(c, ErrorNotDefined, fmt.Sprintf("ERROR:[%s] mcastSession.exchange()::conn.WriteToUDP()::addr:[%s]", err.Error(), addr.String()))
+		return 0, false
+	}
+
+	rcvBuf := make([]byte, MaxPacketSize)
+	retries := 0
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		n, from, err := s.conn.ReadFromUDP(rcvBuf)
+
+		// Operator asked some of us to stop (see Transfer.Abort)
+		if s.dropAborted(c) {
+			return 0, false
+		}
+
+		if isTimeout(err) && retries < MaxRetries {
+			retries++
+			c.t.Retry()
+			metrics.Timeouts.Add(1)
+			c.t.Debug("multicast: timeout, resending", "retry", retries)
+			s.conn.WriteToUDP(buf, addr)
+			continue
+		}
+		if isTimeout(err) {
+			metrics.Timeouts.Add(1)
+		}
+		if err != nil {
+			s.fail(c, ErrorNotDefined, fmt.Sprintf("ERROR:[%s] mcastSession.exchange()::conn.Read()", err.Error()))
+			return 0, false
+		}
+
+		// Only the master ACKs, but any client may give up
+		sender := s.client(from)
+		_, p, err := ParsePacket(rcvBuf[:n])
+		switch {
+		case sender == nil:
+			p := NewPacketError(ErrorUnknownTID, fmt.Sprintf("ERROR: mcastSession.exchange()::unknown client:[%s]", from.String()))
+			s.conn.WriteToUDP(p.Serialize(), from)
+		case err != nil:
+			c.t.Debug("multicast: unable to parse packet", "from", from.String(), "err", err)
+		default:
+			switch p := p.(type) {
+			case *PacketError:
+				sender.t.ErrorCode = int(p.Code)
+				sender.t.Info("multicast: client gave up", "code", p.Code, "msg", p.Msg)
+				s.drop(sender)
+				if sender == c {
+					return 0, false
+				}
+			case *PacketAck:
+				if sender == c {
+					return p.BlockNum, true
+				}
+			}
+		}
+	}
+}
+
+// client is the client in the session at addr, nil if there is none
+func (s *mcastSession) client(addr *net.UDPAddr) *mcastClient {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.clients {
+		if c.t.Client.IP.Equal(addr.IP) && c.t.Client.Port == addr.Port {
+			return c
+		}
+	}
+	return nil
+}
+
+// dropAborted drops the clients an operator aborted, true if the master is one of them
+func (s *mcastSession) dropAborted(master *mcastClient) bool {
+
+	s.mu.Lock()
+	var aborted []*mcastClient
+	for _, c := range s.clients {
+		if c.t.Aborted() {
+			aborted = append(aborted, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range aborted {
+		s.fail(c, ErrorNotDefined, "Transfer aborted by operator")
+	}
+	for _, c := range aborted {
+		if c == master {
+			return true
+		}
+	}
+	return false
+}
+
+// fail sends c an ERROR and drops it
+func (s *mcastSession) fail(c *mcastClient, code uint16, msg string) {
+
+	c.t.Error("sending error", "code", code, "msg", msg)
+	c.t.ErrorCode = int(code)
+	metrics.ErrorSent(code)
+	p := NewPacketError(code, msg)
+	s.conn.WriteToUDP(p.Serialize(), c.t.Client)
+
+	s.drop(c)
+}
+
+// drop takes c out of the session, finishing its transfer
+func (s *mcastSession) drop(c *mcastClient) {
+
+	s.mu.Lock()
+	for i, other := range s.clients {
+		if other == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	c.t.finish()
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface sends conn's multicast out of the interface with the (IPv4) address local
+func setMulticastInterface(conn *net.UDPConn, local net.IP) error {
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var addr [4]byte
+	copy(addr[:], local.To4())
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// setMulticastInterface is a no-op on this platform, multicast goes out of the default interface
+func setMulticastInterface(conn *net.UDPConn, local net.IP) error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mcastGet is a minimal RFC2090 client: it joins the group from the OACK, takes whatever blocks come, and
+// ACKs when it is master; started is closed once it has its first block
+func mcastGet(server *net.UDPAddr, filename string, ackDelay time.Duration, started chan struct{}) ([]byte, error) {
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rrq := PacketRequest{OpRRQ, filename, "octet", map[string]string{"multicast": ""}}
+	if _, err := conn.WriteToUDP(rrq.Serialize(), server); err != nil {
+		return nil, err
+	}
+
+	// Everything, unicast and from the group, comes in on one channel
+	type received struct {
+		buf  []byte
+		from *net.UDPAddr
+	}
+	packets := make(chan received, 1024)
+	read := func(c *net.UDPConn) {
+		for {
+			buf := make([]byte, MaxPacketSize)
+			n, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			packets <- received{buf[:n], from}
+		}
+	}
+	go read(conn)
+
+	blocks := map[uint16][]byte{}
+	var have uint16 // blocks in order
+	last := -1      // the short block, once seen
+	master := false
+	var tid *net.UDPAddr
+	for {
+		var p received
+		select {
+		case p = <-packets:
+		case <-time.After(10 * time.Second):
+			return nil, fmt.Errorf("timeout, have %d blocks, master %v", have, master)
+		}
+
+		opcode, _, _ := parseUint16(p.buf)
+		switch opcode {
+		case OpOAck:
+			oack := PacketOAck{}
+			oack.Parse(p.buf)
+			fields := strings.Split(oack.Options["multicast"], ",")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("unexpected oack %v", oack.Options)
+			}
+			tid = p.from
+			if fields[0] != "" {
+				port, _ := strconv.Atoi(fields[1])
+				group := &net.UDPAddr{IP: net.ParseIP(fields[0]), Port: port}
+				lo, err := net.InterfaceByName("lo")
+				if err != nil {
+					return nil, err
+				}
+				mconn, err := net.ListenMulticastUDP("udp4", lo, group)
+				if err != nil {
+					return nil, err
+				}
+				defer mconn.Close()
+				go read(mconn)
+			}
+			master = fields[2] == "1"
+		case OpError:
+			e := PacketError{}
+			e.Parse(p.buf)
+			return nil, fmt.Errorf("ERROR code:[%d] msg:[%s]", e.Code, e.Msg)
+		case OpData:
+			d := PacketData{}
+			d.Parse(p.buf)
+			if _, ok := blocks[d.BlockNum]; !ok {
+				blocks[d.BlockNum] = d.Data
+				if started != nil {
+					close(started)
+					started = nil
+				}
+			}
+			if len(d.Data) < MaxDataBlockSize {
+				last = int(d.BlockNum)
+			}
+			for _, ok := blocks[have+1]; ok; _, ok = blocks[have+1] {
+				have++
+			}
+		default:
+			continue
+		}
+
+		// The master ACKs what it has in order, on its OACK and on each block
+		if master && opcode != OpError {
+			time.Sleep(ackDelay)
+			ack := PacketAck{have}
+			conn.WriteToUDP(ack.Serialize(), tid)
+			if int(have) == last {
+				var result []byte
+				for i := uint16(1); i <= have; i++ {
+					result = append(result, blocks[i]...)
+				}
+				return result, nil
+			}
+		}
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "board.img")
+	image := make([]byte, 200*MaxDataBlockSize+33)
+	for i := range image {
+		image[i] = byte(i * 5)
+	}
+	os.WriteFile(file, image, 0644)
+
+	groups, _ := ParseMulticastGroups("239.255.69.0/30")
+	t.Cleanup(func() { mcast = nil })
+	mcast = NewMulticast(groups, 41758)
+	server := startServer(t, NewFileNexus())
+
+	// Can this host take multicast on loopback at all?
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	probe, err := net.ListenMulticastUDP("udp4", lo, &net.UDPAddr{IP: net.IPv4(239, 255, 69, 3), Port: 41759})
+	if err != nil {
+		t.Skipf("unable to join a multicast group on loopback: %s", err)
+	}
+	probe.Close()
+
+	// The first board is master from the start; the second joins half way through, picks up the rest from the
+	// group, and is sent what it missed once it is master
+	type result struct {
+		data []byte
+		err  error
+	}
+	first, second := make(chan result, 1), make(chan result, 1)
+	started := make(chan struct{})
+	go func() {
+		data, err := mcastGet(server, file, 2*time.Millisecond, started)
+		first <- result{data, err}
+	}()
+	select {
+	case <-started:
+	case r := <-first:
+		t.Fatalf("board 1: finished before its first block: %v", r.err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		data, err := mcastGet(server, file, 0, nil)
+		second <- result{data, err}
+	}()
+
+	for i, ch := range []chan result{first, second} {
+		r := <-ch
+		if r.err != nil {
+			t.Fatalf("board %d: %s", i+1, r.err)
+		}
+		if !bytes.Equal(r.data, image) {
+			t.Errorf("board %d: expected %d bytes; got %d", i+1, len(image), len(r.data))
+		}
+	}
+
+	// The session is over and its group free again
+	time.Sleep(50 * time.Millisecond)
+	mcast.mu.Lock()
+	sessions, inUse := len(mcast.sessions), len(mcast.inUse)
+	mcast.mu.Unlock()
+	if sessions != 0 || inUse != 0 {
+		t.Errorf("expected no sessions left; got %d sessions, %d groups in use", sessions, inUse)
+	}
+}
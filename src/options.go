@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// errOptionRefused is an option the server won't take, the request is refused with ErrorOptionNegotiation
+var errOptionRefused = errors.New("option refused")
+
+// readOptions answers the options (RFC2347) of an RRQ for entry, nil if there are none to answer; options the
+// server doesn't know are left out. tsize (RFC2349) is the size of the whole file, waiting for a download or
+// decompression of unknown size to finish; offset (not in any RFC) is the byte the transfer starts from, block 1
+// holding the bytes after it. It returns the entry's bytes as they now are.
+func readOptions(t *Transfer, nexus *FileNexus, entry *FileEntry, data []byte, requested map[string]string) (map[string]string, int, []byte, error) {
+
+	oack := make(map[string]string)
+	var err error
+
+	if _, ok := requested["tsize"]; ok {
+		if entry.fill != nil && entry.fill.size < 0 {
+			if data, err = nexus.waitFor(t, entry, math.MaxInt); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		oack["tsize"] = strconv.Itoa(max(entry.expectedSize(data), len(data)))
+	}
+
+	offset := 0
+	if value, ok := requested["offset"]; ok {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return nil, 0, nil, fmt.Errorf("readOptions(): %w, offset:[%s]", errOptionRefused, value)
+		}
+		if data, err = nexus.waitFor(t, entry, offset); err != nil {
+			return nil, 0, nil, err
+		}
+		if offset > len(data) {
+			return nil, 0, nil, fmt.Errorf("readOptions(): %w, offset:[%d] is past the end of the file, size:[%d]", errOptionRefused, offset, len(data))
+		}
+		oack["offset"] = strconv.Itoa(offset)
+	}
+
+	if len(oack) == 0 {
+		return nil, offset, data, nil
+	}
+	return oack, offset, data, nil
+}
+
+// doSendOAck sends the OACK for an RRQ and waits for the client's ACK of block 0, false if the transfer is over
+// (the client turned the options down, or went away)
+func doSendOAck(t *Transfer, conn *net.UDPConn, remoteAddr *net.UDPAddr, options map[string]string, timeout int) bool {
+
+	t.Debug("sending oack", "options", options)
+	oackPacket := PacketOAck{Options: options}
+	oackBuffer := oackPacket.Serialize()
+	if _, err := conn.WriteToUDP(oackBuffer, remoteAddr); err != nil {
+		errmsg := fmt.Sprintf("ERROR:[%s] doSendOAck()::conn.WriteToUDP()::remoteAddr:[%s]", err.Error(), remoteAddr.String())
+		doSendError(t, ErrorNotDefined, errmsg)
+		return false
+	}
+
+	buf := make([]byte, MaxPacketSize)
+	retries := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		n, readRemoteAddr, err := conn.ReadFromUDP(buf)
+
+		// Operator asked us to stop (see Transfer.Abort)
+		if t.Aborted() {
+			doSendError(t, ErrorNotDefined, "Transfer aborted by operator")
+			return false
+		}
+
+		// Timeout: the OACK or its ACK went missing, send it again
+		if isTimeout(err) && retries < MaxRetries {
+			retries++
+			t.Retry()
+			metrics.Timeouts.Add(1)
+			t.Debug("timeout, resending oack", "retry", retries)
+			conn.WriteToUDP(oackBuffer, remoteAddr)
+			continue
+		}
+		if isTimeout(err) {
+			metrics.Timeouts.Add(1)
+		}
+		if err != nil {
+			errmsg := fmt.Sprintf("ERROR:[%s] doSendOAck()::conn.Read()::readRemoteAdrr:[%s]\n", err.Error(), readRemoteAddr)
+			doSendError(t, ErrorNotDefined, errmsg)
+			return false
+		}
+		if readRemoteAddr.Port != remoteAddr.Port {
+			errmsg := fmt.Sprintf("ERROR: doSendOAck()::remoteAddr.Port:[%d] != readRemoteAddr.Port:[%d] ", remoteAddr.Port, readRemoteAddr.Port)
+			t.Error("unknown transfer id", "from", readRemoteAddr.String())
+			p := NewPacketError(ErrorUnknownTID, errmsg)
+			conn.WriteToUDP(p.Serialize(), readRemoteAddr)
+			continue
+		}
+
+		_, p, err := ParsePacket(buf[:n])
+		switch p := p.(type) {
+		case *PacketAck:
+			if p.BlockNum == 0 {
+				return true
+			}
+		case *PacketError:
+			// The client turned the options down (RFC2347), it doesn't want an ERROR back
+			t.ErrorCode = int(p.Code)
+			t.Info("options refused by client", "code", p.Code, "msg", p.Msg)
+			return false
+		}
+		if err != nil {
+			errmsg := fmt.Sprintf("ERROR:[%s] doSendOAck()::ParsePacket()", err.Error())
+			doSendError(t, ErrorNotDefined, errmsg)
+			return false
+		}
+	}
+}
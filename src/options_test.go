@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadOffset(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "big.img")
+	image := make([]byte, 10*MaxDataBlockSize+100)
+	for i := range image {
+		image[i] = byte(i * 13)
+	}
+	os.WriteFile(file, image, 0644)
+
+	server := startServer(t, NewFileNexus())
+	local := net.IPv4(127, 0, 0, 1)
+
+	// Resume part way through a block: tsize is still the whole file
+	for _, offset := range []int{1000, 4 * MaxDataBlockSize, len(image)} {
+		data, oack, err := tftpGetOptions(local, server, file, map[string]string{"offset": strconv.Itoa(offset), "tsize": "0"})
+		if err != nil {
+			t.Fatalf("offset %d: %s", offset, err)
+		}
+		if !bytes.Equal(data, image[offset:]) {
+			t.Errorf("offset %d: expected %d bytes from there; got %d", offset, len(image)-offset, len(data))
+		}
+		if oack["offset"] != strconv.Itoa(offset) || oack["tsize"] != strconv.Itoa(len(image)) {
+			t.Errorf("offset %d: unexpected oack %v", offset, oack)
+		}
+	}
+
+	// Past the end, or not a number: refused
+	for _, offset := range []string{strconv.Itoa(len(image) + 1), "-1", "half"} {
+		_, _, err := tftpGetOptions(local, server, file, map[string]string{"offset": offset})
+		if err == nil || !strings.Contains(err.Error(), "code:[8]") {
+			t.Errorf("offset %s: expected ErrorOptionNegotiation; got %v", offset, err)
+		}
+	}
+}
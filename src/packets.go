@@ -16,6 +16,7 @@ const (
 	ErrorUnknownTID          uint16 = iota
 	ErrorFileExists          uint16 = iota
 	ErrorUnknownUser         uint16 = iota
+	ErrorOptionNegotiation   uint16 = iota // RFC2347
 )
 
 // NewPacketError will create the struct PacketError
@@ -46,6 +47,9 @@ func makePacketRequest(buf []byte) PacketRequest {
 	m := bytes.Index(buf[n+3:], []byte{0})
 	p.Mode = string(buf[n+3 : n+3+m])
 
+	// Options (RFC2347) follow the Mode, as name/value pairs
+	p.Options, _ = parseOptions(buf[n+3+m+1:])
+
 	return p
 }
 
@@ -62,10 +66,11 @@ func makePacketData(blockNum uint16, buf []byte, pos int, size int) PacketData {
 	return p
 }
 
-// RawPacket is the raw-bytes received over wire, with the RemoteAddr saved
+// RawPacket is the raw-bytes received over wire, with the RemoteAddr and the LocalAddr it was sent to saved
 type RawPacket struct {
-	Addr  *net.UDPAddr
-	bytes []byte
+	Addr      *net.UDPAddr
+	LocalAddr *net.UDPAddr
+	bytes     []byte
 }
 
 func (packet RawPacket) getBytes() []byte {
@@ -0,0 +1,73 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// packetInfoSize is large enough for one IP_PKTINFO or IPV6_PKTINFO control message
+const packetInfoSize = 64
+
+// enablePacketInfo asks the kernel to report the destination address of every datagram on conn
+func enablePacketInfo(conn *net.UDPConn) error {
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// A wildcard listener may be dual-stack, so ask for both, only one has to stick
+		errV4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		errV6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		if errV4 != nil && errV6 != nil {
+			sockErr = errV4
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// parsePacketInfo returns the local address (and zone for link-local IPv6) a datagram was sent to,
+// the IP is nil if the oob data doesn't say
+func parsePacketInfo(oob []byte) (net.IP, string) {
+
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, ""
+	}
+
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO:
+			// struct in_pktinfo { int ipi_ifindex; struct in_addr ipi_spec_dst; struct in_addr ipi_addr; }
+			// NOTE: ipi_spec_dst is the local address, ipi_addr may be a broadcast address
+			if len(m.Data) >= 12 {
+				return net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]), ""
+			}
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO:
+			// struct in6_pktinfo { struct in6_addr ipi6_addr; unsigned int ipi6_ifindex; }
+			if len(m.Data) >= 20 {
+				ip := make(net.IP, net.IPv6len)
+				copy(ip, m.Data[:16])
+				zone := ""
+				if ip.IsLinkLocalUnicast() {
+					ifindex := binary.NativeEndian.Uint32(m.Data[16:20])
+					if iface, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+						zone = iface.Name
+					}
+				}
+				return ip, zone
+			}
+		}
+	}
+
+	return nil, ""
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplySourceAddress(t *testing.T) {
+	// Linux routes all of 127.0.0.0/8 to "lo", so these behave like aliases on a multi-homed host
+	aliases := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}
+
+	filename := filepath.Join(t.TempDir(), "pktinfo.dat")
+	if err := os.WriteFile(filename, []byte("fnord"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveUntilCleanup(t, listener, NewFileNexus())
+
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	for _, alias := range aliases {
+		serverAddr := &net.UDPAddr{IP: net.ParseIP(alias), Port: port}
+
+		client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+
+		rrq := PacketRequest{OpRRQ, filename, "octet", nil}
+		if _, err := client.WriteToUDP(rrq.Serialize(), serverAddr); err != nil {
+			t.Fatalf("Sending RRQ to %s: %s", serverAddr, err)
+		}
+
+		buf := make([]byte, MaxPacketSize)
+		n, replyAddr, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Reading reply from %s: %s", serverAddr, err)
+		}
+		if !replyAddr.IP.Equal(serverAddr.IP) {
+			t.Errorf("RRQ sent to %s: expected reply from %s; got %s", serverAddr, serverAddr.IP, replyAddr.IP)
+		}
+
+		data := PacketData{}
+		if err := data.Parse(buf[:n]); err != nil {
+			t.Fatalf("Parsing DATA from %s: %s", replyAddr, err)
+		}
+		ack := PacketAck{data.BlockNum}
+		client.WriteToUDP(ack.Serialize(), replyAddr)
+		client.Close()
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// packetInfoSize is zero, as destination addresses aren't available on this platform
+const packetInfoSize = 0
+
+// enablePacketInfo is a no-op on this platform, replies are sent from the wildcard address
+func enablePacketInfo(conn *net.UDPConn) error {
+	return nil
+}
+
+// parsePacketInfo never knows the local address on this platform
+func parsePacketInfo(oob []byte) (net.IP, string) {
+	return nil, ""
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// DropPrivileges isn't supported on this platform, asking for it is an error rather than silently running as-is
+func DropPrivileges(userName string, groupName string, chrootDir string) error {
+	if userName != "" || groupName != "" || chrootDir != "" {
+		return fmt.Errorf("DropPrivileges(): not supported on this platform")
+	}
+	return nil
+}
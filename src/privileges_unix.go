@@ -0,0 +1,65 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges optionally chroots to chrootDir and switches to userName/groupName, it is called once
+// the listener is bound. Empty params are left alone, the group defaults to the user's primary group.
+func DropPrivileges(userName string, groupName string, chrootDir string) error {
+
+	uid, gid := -1, -1
+
+	// Resolve names *before* chroot, as /etc/passwd and /etc/group likely aren't in there
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return fmt.Errorf("DropPrivileges(): user:[%s] err.Error():[%s]", userName, err.Error())
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return fmt.Errorf("DropPrivileges(): group:[%s] err.Error():[%s]", groupName, err.Error())
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// Chroot: the new root becomes the serve root
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			return fmt.Errorf("DropPrivileges(): chroot:[%s] err.Error():[%s]", chrootDir, err.Error())
+		}
+		if err := os.Chdir("/"); err != nil {
+			return fmt.Errorf("DropPrivileges(): chdir after chroot err.Error():[%s]", err.Error())
+		}
+		logger.Info("privileges: chroot", "dir", chrootDir)
+	}
+
+	// Order matters: group first, as once we're not root we can't change it
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("DropPrivileges(): setgroups:[%d] err.Error():[%s]", gid, err.Error())
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("DropPrivileges(): setgid:[%d] err.Error():[%s]", gid, err.Error())
+		}
+		logger.Info("privileges: setgid", "gid", gid)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("DropPrivileges(): setuid:[%d] err.Error():[%s]", uid, err.Error())
+		}
+		logger.Info("privileges: setuid", "uid", uid)
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DHCP message types, and the options a proxyDHCP responder reads or sets
+const (
+	DHCPDiscover = 1
+	DHCPOffer    = 2
+	DHCPRequest  = 3
+	DHCPAck      = 5
+
+	OptionServerName     = 66 // TFTP server, for firmware that reads it rather than siaddr
+	OptionBootFile       = 67 // boot filename, for firmware that reads it rather than file
+	OptionVendorSpecific = 43 // PXE options
+	OptionMessageType    = 53
+	OptionServerID       = 54
+	OptionVendorClass    = 60 // "PXEClient:..." from a PXE client
+	OptionClientArch     = 93 // RFC4578
+	OptionClientMachine  = 97 // UUID/GUID, echoed back (PXE spec)
+	OptionEnd            = 255
+)
+
+// maxPXEClients caps the PXE clients remembered for the host table, they are forgotten all at once past it
+const maxPXEClients = 4096
+
+// dhcpMagic starts the options, after the BOOTP header
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// proxyDHCP answers PXE clients with a boot filename and TFTP server, nil when it isn't running
+var proxyDHCP *ProxyDHCP
+
+// pxeArches are the client architectures (RFC4578 option 93) known by name, as given to --pxe-boot
+var pxeArches = map[string][]uint16{
+	"bios":  {0},
+	"efi32": {6},
+	"efi64": {7, 9},
+	"arm32": {10},
+	"arm64": {11},
+}
+
+// PXEBoot is the boot file for a client MAC address, or for client architectures
+type PXEBoot struct {
+	MAC    net.HardwareAddr // nil for an architecture or the default
+	Arches []uint16         // nil for a MAC or the default
+	File   string
+}
+
+// ProxyDHCP is a proxyDHCP responder (PXE spec): it leaves addresses to the real DHCP server, and only hands
+// out next-server and the boot filename, the file chosen by MAC, then architecture, then the default
+type ProxyDHCP struct {
+	Server   net.IP // TFTP server handed out, nil for the local address the request came in on
+	boots    []PXEBoot
+	fallback string // "" sends nothing to clients matching no boot file
+
+	mu     sync.Mutex
+	arches map[string]uint16           // by MAC, the architecture each PXE client last sent
+	macs   map[string]net.HardwareAddr // by IP, PXE clients that asked with an address of their own
+}
+
+// NewProxyDHCP creates the struct, a boot with neither MAC nor Arches is the default
+func NewProxyDHCP(server net.IP, boots []PXEBoot) *ProxyDHCP {
+
+	p := &ProxyDHCP{
+		Server: server,
+		arches: make(map[string]uint16),
+		macs:   make(map[string]net.HardwareAddr),
+	}
+	for _, boot := range boots {
+		if boot.MAC == nil && boot.Arches == nil {
+			p.fallback = boot.File
+			continue
+		}
+		p.boots = append(p.boots, boot)
+	}
+
+	return p
+}
+
+// BootFile is the boot filename for a client, false if there is none
+func (p *ProxyDHCP) BootFile(mac net.HardwareAddr, arch uint16, hasArch bool) (string, bool) {
+
+	for _, boot := range p.boots {
+		if boot.MAC != nil && bytes.Equal(boot.MAC, mac) {
+			return boot.File, true
+		}
+	}
+	for _, boot := range p.boots {
+		for _, a := range boot.Arches {
+			if hasArch && a == arch {
+				return boot.File, true
+			}
+		}
+	}
+
+	return p.fallback, p.fallback != ""
+}
+
+// remember records a PXE client's architecture, and the MAC behind client (its address, if it has one yet), for
+// the host table
+func (p *ProxyDHCP) remember(req *DHCPPacket, client net.IP) {
+
+	if !strings.HasPrefix(string(req.Options[OptionVendorClass]), "PXEClient") || len(req.CHAddr) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.arches) >= maxPXEClients || len(p.macs) >= maxPXEClients {
+		p.arches = make(map[string]uint16)
+		p.macs = make(map[string]net.HardwareAddr)
+	}
+	if a := req.Options[OptionClientArch]; len(a) >= 2 {
+		p.arches[req.CHAddr.String()] = binary.BigEndian.Uint16(a)
+	}
+	if client.To4() != nil && !client.IsUnspecified() {
+		p.macs[client.To4().String()] = req.CHAddr
+	}
+}
+
+// MAC is the MAC of the PXE client that asked from ip, nil if there was none (or the responder isn't running)
+func (p *ProxyDHCP) MAC(ip net.IP) net.HardwareAddr {
+	if p == nil || ip.To4() == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.macs[ip.To4().String()]
+}
+
+// Arch is the architecture the PXE client with mac last sent, false if it sent none
+func (p *ProxyDHCP) Arch(mac net.HardwareAddr) (uint16, bool) {
+	if p == nil || mac == nil {
+		return 0, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	arch, ok := p.arches[mac.String()]
+	return arch, ok
+}
+
+// Reply is the answer to a PXE client's DISCOVER (an OFFER) or REQUEST (an ACK) received on local, nil if the
+// request isn't one to answer
+func (p *ProxyDHCP) Reply(req *DHCPPacket, local net.IP) *DHCPPacket {
+
+	if req.Op != 1 || !strings.HasPrefix(string(req.Options[OptionVendorClass]), "PXEClient") {
+		return nil
+	}
+	var msgType byte
+	switch t := req.Options[OptionMessageType]; {
+	case len(t) == 1 && t[0] == DHCPDiscover:
+		msgType = DHCPOffer
+	case len(t) == 1 && t[0] == DHCPRequest:
+		msgType = DHCPAck
+	default:
+		return nil
+	}
+
+	arch, hasArch := uint16(0), false
+	if a := req.Options[OptionClientArch]; len(a) >= 2 {
+		arch, hasArch = binary.BigEndian.Uint16(a), true
+	}
+	file, ok := p.BootFile(req.CHAddr, arch, hasArch)
+	if !ok {
+		return nil
+	}
+
+	server := p.Server
+	if server == nil {
+		server = local
+	}
+	if server.To4() == nil || server.IsUnspecified() {
+		return nil
+	}
+
+	reply := &DHCPPacket{
+		Op:     2,
+		HType:  req.HType,
+		HLen:   req.HLen,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		CIAddr: req.CIAddr,
+		YIAddr: net.IPv4zero,
+		SIAddr: server.To4(),
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		File:   file,
+		Options: map[byte][]byte{
+			OptionMessageType: {msgType},
+			OptionServerID:    server.To4(),
+			OptionVendorClass: []byte("PXEClient"),
+			// PXE_DISCOVERY_CONTROL (6) = 8: boot the file given, no boot server discovery or menu
+			OptionVendorSpecific: {6, 1, 8, OptionEnd},
+			OptionServerName:     []byte(server.String()),
+			OptionBootFile:       []byte(file),
+		},
+	}
+	if guid, ok := req.Options[OptionClientMachine]; ok {
+		reply.Options[OptionClientMachine] = guid
+	}
+
+	return reply
+}
+
+// Serve answers requests on conn until it is closed: on port 67 DISCOVERs, broadcast back (or sent to the
+// relay), on port 4011 REQUESTs, sent back to the client
+func (p *ProxyDHCP) Serve(conn *net.UDPConn) {
+
+	if err := enablePacketInfo(conn); err != nil {
+		logger.Error("proxydhcp: unable to enable packet info", "err", err)
+	}
+	if err := enableBroadcast(conn); err != nil {
+		logger.Error("proxydhcp: unable to enable broadcast", "err", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	for {
+		buf := make([]byte, 1500)
+		oob := make([]byte, packetInfoSize)
+		n, oobn, _, from, err := conn.ReadMsgUDP(buf, oob)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Error("proxydhcp: read failed", "err", err)
+			continue
+		}
+
+		req := &DHCPPacket{}
+		if err := req.Parse(buf[:n]); err != nil {
+			logger.Debug("proxydhcp: unable to parse packet", "client", from.String(), "err", err)
+			continue
+		}
+		if t := req.Options[OptionMessageType]; port != 4011 && (len(t) != 1 || t[0] != DHCPDiscover) {
+			continue // REQUESTs on 67 are for the real DHCP server
+		}
+		if port == 4011 {
+			p.remember(req, from.IP)
+		} else {
+			p.remember(req, req.CIAddr)
+		}
+
+		// The server handed out is the local address the request came in on, or the one facing a client with an
+		// address of its own
+		local, _ := parsePacketInfo(oob[:oobn])
+		if (local == nil || local.IsUnspecified()) && !from.IP.IsUnspecified() {
+			local = routeSource(from)
+		}
+		reply := p.Reply(req, local)
+		if reply == nil {
+			continue
+		}
+
+		to := from
+		if port != 4011 {
+			switch {
+			case !req.GIAddr.IsUnspecified():
+				to = &net.UDPAddr{IP: req.GIAddr, Port: 67}
+			default:
+				to = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+			}
+		}
+		logger.Info("proxydhcp: boot file", "mac", req.CHAddr.String(), "file", reply.File, "server", reply.SIAddr.String(), "to", to.String())
+		if _, err := conn.WriteToUDP(reply.Serialize(), to); err != nil {
+			logger.Error("proxydhcp: unable to reply", "to", to.String(), "err", err)
+		}
+	}
+}
+
+// ParsePXEBoots parses "mac=file", "arch=file" (a number, or bios, efi32, efi64, arm32, arm64) and "*=file"
+// pairs, as given to --pxe-boot
+func ParsePXEBoots(specs []string) ([]PXEBoot, error) {
+
+	var result []PXEBoot
+	for _, spec := range specs {
+		key, file, ok := strings.Cut(spec, "=")
+		if !ok || file == "" {
+			return nil, fmt.Errorf("ParsePXEBoots(): expected mac=file, arch=file or *=file, got:[%s]", spec)
+		}
+
+		boot := PXEBoot{File: file}
+		if key != "*" {
+			if mac, err := net.ParseMAC(key); err == nil {
+				boot.MAC = mac
+			} else if arches, ok := parseArch(key); ok {
+				boot.Arches = arches
+			} else {
+				return nil, fmt.Errorf("ParsePXEBoots(): not a MAC address or an architecture:[%s]", key)
+			}
+		}
+		result = append(result, boot)
+	}
+
+	return result, nil
+}
+
+// parseArch parses an architecture name from pxeArches, or an RFC4578 number
+func parseArch(key string) ([]uint16, bool) {
+	if arches, ok := pxeArches[strings.ToLower(key)]; ok {
+		return arches, true
+	}
+	if arch, err := strconv.ParseUint(key, 10, 16); err == nil {
+		return []uint16{uint16(arch)}, true
+	}
+	return nil, false
+}
+
+// DHCPPacket is a BOOTP/DHCP message (RFC2131), without the fields a proxyDHCP responder has no use for
+type DHCPPacket struct {
+	Op      byte // 1 request, 2 reply
+	HType   byte
+	HLen    byte
+	XID     uint32
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	File    string
+	Options map[byte][]byte
+}
+
+// Parse parses a DHCP message from its wire representation
+func (p *DHCPPacket) Parse(buf []byte) error {
+
+	if len(buf) < 240 || !bytes.Equal(buf[236:240], dhcpMagic) {
+		return errors.New("not a DHCP message")
+	}
+	p.Op, p.HType, p.HLen = buf[0], buf[1], buf[2]
+	if p.HLen > 16 {
+		return errors.New("hardware address too long")
+	}
+	p.XID = binary.BigEndian.Uint32(buf[4:8])
+	p.Flags = binary.BigEndian.Uint16(buf[10:12])
+	p.CIAddr = net.IP(append([]byte{}, buf[12:16]...))
+	p.YIAddr = net.IP(append([]byte{}, buf[16:20]...))
+	p.SIAddr = net.IP(append([]byte{}, buf[20:24]...))
+	p.GIAddr = net.IP(append([]byte{}, buf[24:28]...))
+	p.CHAddr = net.HardwareAddr(append([]byte{}, buf[28:28+p.HLen]...))
+	p.File = string(bytes.TrimRight(buf[108:236], "\x00"))
+
+	p.Options = make(map[byte][]byte)
+	opts := buf[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == OptionEnd {
+			break
+		}
+		if code == 0 { // pad
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return errors.New("option truncated")
+		}
+		p.Options[code] = append(p.Options[code], opts[2:2+opts[1]]...)
+		opts = opts[2+opts[1]:]
+	}
+
+	return nil
+}
+
+// Serialize writes the message, the message type option first and the others in code order
+func (p *DHCPPacket) Serialize() []byte {
+
+	buf := make([]byte, 240)
+	buf[0], buf[1], buf[2] = p.Op, p.HType, p.HLen
+	binary.BigEndian.PutUint32(buf[4:8], p.XID)
+	binary.BigEndian.PutUint16(buf[10:12], p.Flags)
+	copy(buf[12:16], p.CIAddr.To4())
+	copy(buf[16:20], p.YIAddr.To4())
+	copy(buf[20:24], p.SIAddr.To4())
+	copy(buf[24:28], p.GIAddr.To4())
+	copy(buf[28:44], p.CHAddr)
+	copy(buf[108:235], p.File)
+	copy(buf[236:240], dhcpMagic)
+
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != OptionMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if t, ok := p.Options[OptionMessageType]; ok {
+		buf = append(buf, OptionMessageType, byte(len(t)))
+		buf = append(buf, t...)
+	}
+	for _, code := range codes {
+		value := p.Options[byte(code)]
+		if len(value) > 255 {
+			value = value[:255]
+		}
+		buf = append(buf, byte(code), byte(len(value)))
+		buf = append(buf, value...)
+	}
+	buf = append(buf, OptionEnd)
+
+	// Some PXE ROMs drop replies shorter than a BOOTP message
+	for len(buf) < 300 {
+		buf = append(buf, 0)
+	}
+
+	return buf
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// pxeRequest is a PXE client's DISCOVER or REQUEST, with the architecture given unless arch is negative
+func pxeRequest(msgType byte, mac string, arch int) *DHCPPacket {
+	hw, _ := net.ParseMAC(mac)
+	req := &DHCPPacket{
+		Op:     1,
+		HType:  1,
+		HLen:   6,
+		XID:    0x1234abcd,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: hw,
+		Options: map[byte][]byte{
+			OptionMessageType:   {msgType},
+			OptionVendorClass:   []byte("PXEClient:Arch:00007:UNDI:003016"),
+			OptionClientMachine: {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		},
+	}
+	if arch >= 0 {
+		req.Options[OptionClientArch] = []byte{byte(arch >> 8), byte(arch)}
+	}
+	return req
+}
+
+func TestDHCPPacket(t *testing.T) {
+	req := pxeRequest(DHCPDiscover, "52:54:00:12:34:56", 7)
+	req.File = "ignored.efi"
+	buf := req.Serialize()
+	if len(buf) < 300 || buf[240] != OptionMessageType {
+		t.Fatalf("expected at least 300 bytes, message type first; got %d bytes, option %d first", len(buf), buf[240])
+	}
+
+	got := &DHCPPacket{}
+	if err := got.Parse(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got.XID != req.XID || got.CHAddr.String() != req.CHAddr.String() || got.File != req.File {
+		t.Errorf("expected %+v; got %+v", req, got)
+	}
+	for code, value := range req.Options {
+		if !bytes.Equal(got.Options[code], value) {
+			t.Errorf("option %d: expected %v; got %v", code, value, got.Options[code])
+		}
+	}
+
+	for _, bad := range [][]byte{buf[:239], append(append([]byte{}, buf[:240]...), OptionBootFile, 10, 'x')} {
+		if err := (&DHCPPacket{}).Parse(bad); err == nil {
+			t.Errorf("expected an error for %d bytes", len(bad))
+		}
+	}
+}
+
+func TestProxyDHCPReply(t *testing.T) {
+	boots, err := ParsePXEBoots([]string{"52:54:00:12:34:56=board7.efi", "efi64=ipxe.efi", "0=undionly.kpxe", "*=default.efi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxyDHCP(nil, boots)
+	local := net.IPv4(192, 168, 7, 1)
+
+	tests := []struct {
+		msgType byte
+		mac     string
+		arch    int
+		reply   byte
+		file    string
+	}{
+		{DHCPDiscover, "52:54:00:12:34:56", 7, DHCPOffer, "board7.efi"},
+		{DHCPRequest, "52:54:00:12:34:56", 0, DHCPAck, "board7.efi"},
+		{DHCPDiscover, "52:54:00:00:00:01", 9, DHCPOffer, "ipxe.efi"},
+		{DHCPDiscover, "52:54:00:00:00:01", 0, DHCPOffer, "undionly.kpxe"},
+		{DHCPDiscover, "52:54:00:00:00:01", 11, DHCPOffer, "default.efi"},
+		{DHCPDiscover, "52:54:00:00:00:01", -1, DHCPOffer, "default.efi"},
+	}
+	for _, test := range tests {
+		req := pxeRequest(test.msgType, test.mac, test.arch)
+		reply := p.Reply(req, local)
+		if reply == nil {
+			t.Errorf("%s arch %d: expected a reply", test.mac, test.arch)
+			continue
+		}
+		if reply.File != test.file || string(reply.Options[OptionBootFile]) != test.file {
+			t.Errorf("%s arch %d: expected %s; got %s", test.mac, test.arch, test.file, reply.File)
+		}
+		if !bytes.Equal(reply.Options[OptionMessageType], []byte{test.reply}) {
+			t.Errorf("%s arch %d: expected message type %d; got %v", test.mac, test.arch, test.reply, reply.Options[OptionMessageType])
+		}
+		if !reply.SIAddr.Equal(local) || string(reply.Options[OptionServerName]) != "192.168.7.1" {
+			t.Errorf("%s arch %d: expected server %s; got %s", test.mac, test.arch, local, reply.SIAddr)
+		}
+		if reply.XID != req.XID || !bytes.Equal(reply.Options[OptionClientMachine], req.Options[OptionClientMachine]) {
+			t.Errorf("%s arch %d: expected xid and guid echoed", test.mac, test.arch)
+		}
+	}
+
+	// Not a PXE client, or not a DISCOVER or REQUEST: left to the real DHCP server
+	plain := pxeRequest(DHCPDiscover, "52:54:00:00:00:01", -1)
+	plain.Options[OptionVendorClass] = []byte("MSFT 5.0")
+	if p.Reply(plain, local) != nil {
+		t.Errorf("expected no reply to a client that isn't PXE")
+	}
+	if p.Reply(pxeRequest(DHCPAck, "52:54:00:00:00:01", 7), local) != nil {
+		t.Errorf("expected no reply to an ACK")
+	}
+
+	// No default: clients matching nothing aren't answered; a fixed server overrides the local address
+	p = NewProxyDHCP(net.IPv4(10, 0, 0, 5), boots[:2])
+	if p.Reply(pxeRequest(DHCPDiscover, "52:54:00:00:00:01", 0), local) != nil {
+		t.Errorf("expected no reply without a boot file")
+	}
+	if reply := p.Reply(pxeRequest(DHCPDiscover, "52:54:00:00:00:01", 7), local); reply == nil || !reply.SIAddr.Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("expected server 10.0.0.5; got %+v", reply)
+	}
+
+	for _, spec := range []string{"efi64", "riscv=x.efi", "52:54:00=x.efi="} {
+		if _, err := ParsePXEBoots([]string{spec}); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
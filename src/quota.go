@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirUsageTTL is how long a quota directory's walked size is trusted, uploads through the server keep it current
+// in between
+const dirUsageTTL = time.Minute
+
+// quotas guards uploads against size limits and disk space, it allows everything until configured
+var quotas = NewQuotas(QuotaConfig{})
+
+// QuotaConfig are the upload limits in bytes, zero values turn a limit off
+type QuotaConfig struct {
+	MaxFileSize int64            // per upload
+	ClientQuota int64            // uploaded per client IP, since the server started
+	DirQuotas   map[string]int64 // total size of the files under a directory
+	MinFree     int64            // free space left on the target filesystem
+}
+
+// Quotas tracks client usage and the bytes of uploads in progress, which aren't on disk yet
+type Quotas struct {
+	config QuotaConfig
+
+	mu             sync.Mutex
+	clientUsage    map[string]int64
+	clientInflight map[string]int64
+	dirUsage       map[string]*dirScan
+	dirInflight    map[string]int64
+	inflight       int64
+}
+
+// dirScan is the size of the files under a quota directory, as of its last walk and the uploads saved since
+type dirScan struct {
+	total  int64
+	walked time.Time
+}
+
+// Upload is one WRQ's claim against the quotas, it grows as blocks arrive
+type Upload struct {
+	q        *Quotas
+	client   string
+	dir      string // quota directory the file falls under, "" for none
+	dirQuota int64
+	replaced int64 // size of the file the upload replaces, it doesn't count against the directory
+	free     int64 // on disk when the upload began, -1 if unknown
+	size     int64
+}
+
+// NewQuotas creates the struct
+func NewQuotas(config QuotaConfig) *Quotas {
+	return &Quotas{
+		config:         config,
+		clientUsage:    make(map[string]int64),
+		clientInflight: make(map[string]int64),
+		dirUsage:       make(map[string]*dirScan),
+		dirInflight:    make(map[string]int64),
+	}
+}
+
+// SetConfig replaces the limits, uploads in progress are checked against the new ones from their next block
+func (q *Quotas) SetConfig(config QuotaConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.config = config
+}
+
+// Begin claims an upload of filename by client, failing if a limit is already reached
+func (q *Quotas) Begin(client net.IP, filename string) (*Upload, error) {
+
+	u := &Upload{q: q, client: client.String(), free: -1}
+	target := filepath.Clean(filename)
+
+	q.mu.Lock()
+	config := q.config
+	q.mu.Unlock()
+
+	// Quota directory: the closest configured one containing the file
+	for dir, quota := range config.DirQuotas {
+		dir = filepath.Clean(dir)
+		if (dir == "." || strings.HasPrefix(target, dir+string(filepath.Separator))) && len(dir) >= len(u.dir) {
+			u.dir, u.dirQuota = dir, quota
+		}
+	}
+	if u.dir != "" {
+		if err := q.scanDir(u.dir); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(target); err == nil && info.Mode().IsRegular() {
+			u.replaced = info.Size()
+		}
+	}
+
+	if config.MinFree > 0 {
+		free, err := diskFree(filepath.Dir(target))
+		if err != nil {
+			return nil, err
+		}
+		u.free = free
+	}
+
+	// A zero byte file may still be over, if the quota is already used up
+	return u, u.Grow(0)
+}
+
+// Grow adds n received bytes to the upload, failing if that takes it past a limit
+func (u *Upload) Grow(n int) error {
+
+	q := u.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := u.size + int64(n)
+
+	if q.config.MaxFileSize > 0 && size > q.config.MaxFileSize {
+		return fmt.Errorf("File exceeds the maximum size of %d bytes", q.config.MaxFileSize)
+	}
+	if q.config.ClientQuota > 0 && q.clientUsage[u.client]+q.clientInflight[u.client]+int64(n) > q.config.ClientQuota {
+		return fmt.Errorf("Client upload quota of %d bytes exceeded", q.config.ClientQuota)
+	}
+	if u.dir != "" && q.dirUsage[u.dir].total-u.replaced+q.dirInflight[u.dir]+int64(n) > u.dirQuota {
+		return fmt.Errorf("Directory quota of %d bytes exceeded", u.dirQuota)
+	}
+	if u.free >= 0 && u.free-q.inflight-int64(n) < q.config.MinFree {
+		return fmt.Errorf("Disk full, less than %d bytes would be left free", q.config.MinFree)
+	}
+
+	u.size = size
+	q.inflight += int64(n)
+	q.clientInflight[u.client] += int64(n)
+	if u.dir != "" {
+		q.dirInflight[u.dir] += int64(n)
+	}
+	return nil
+}
+
+// End releases the upload's claim, a saved upload counts against the client's quota and its directory from now on
+func (u *Upload) End(saved bool) {
+
+	q := u.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight -= u.size
+	if q.clientInflight[u.client] -= u.size; q.clientInflight[u.client] == 0 {
+		delete(q.clientInflight, u.client)
+	}
+	if u.dir != "" {
+		q.dirInflight[u.dir] -= u.size
+	}
+	if saved {
+		q.clientUsage[u.client] += u.size
+		if u.dir != "" {
+			q.dirUsage[u.dir].total += u.size - u.replaced
+		}
+	}
+}
+
+// scanDir walks a quota directory for its size, unless it was walked in the last dirUsageTTL
+func (q *Quotas) scanDir(dir string) error {
+
+	q.mu.Lock()
+	scan, ok := q.dirUsage[dir]
+	q.mu.Unlock()
+	if ok && time.Since(scan.walked) < dirUsageTTL {
+		return nil
+	}
+
+	total, err := dirUsage(dir)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if scan, ok := q.dirUsage[dir]; ok {
+		scan.total, scan.walked = total, time.Now()
+	} else {
+		q.dirUsage[dir] = &dirScan{total: total, walked: time.Now()}
+	}
+	return nil
+}
+
+// dirUsage is the total size of the regular files under dir
+func dirUsage(dir string) (int64, error) {
+
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil && !isNotExist(err) {
+		return 0, fmt.Errorf("dirUsage(): dir:[%s] err.Error():[%s]", dir, err.Error())
+	}
+
+	return total, nil
+}
+
+// ParseDirQuotas parses "dir=size" pairs, as given to --quota-dir
+func ParseDirQuotas(specs []string) (map[string]int64, error) {
+
+	result := make(map[string]int64)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("ParseDirQuotas(): expected dir=size, got:[%s]", spec)
+		}
+		size, err := ParseByteSize(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		result[spec[:i]] = size
+	}
+
+	return result, nil
+}
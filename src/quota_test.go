@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotaLimits(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "existing.bin"), make([]byte, 1000), 0644)
+	client := net.IPv4(10, 0, 0, 5)
+
+	// Max file size
+	q := NewQuotas(QuotaConfig{MaxFileSize: 100})
+	u, _ := q.Begin(client, filepath.Join(dir, "a.bin"))
+	if err := u.Grow(100); err != nil {
+		t.Errorf("max-file-size: unexpected error at the limit: %s", err)
+	}
+	if err := u.Grow(1); err == nil {
+		t.Errorf("max-file-size: expected error past the limit")
+	}
+
+	// Directory: 1000 bytes already there, the file being replaced doesn't count
+	q = NewQuotas(QuotaConfig{DirQuotas: map[string]int64{dir: 1200}})
+	u, _ = q.Begin(client, filepath.Join(dir, "existing.bin"))
+	if err := u.Grow(1100); err != nil {
+		t.Errorf("quota-dir: unexpected error replacing a file: %s", err)
+	}
+	other, _ := q.Begin(client, filepath.Join(dir, "other.bin"))
+	if err := other.Grow(1); err == nil {
+		t.Errorf("quota-dir: expected error, as in-flight uploads count")
+	}
+	u.End(false)
+	if err := other.Grow(200); err != nil {
+		t.Errorf("quota-dir: unexpected error once the other upload ended: %s", err)
+	}
+	if err := other.Grow(1); err == nil {
+		t.Errorf("quota-dir: expected error past the limit")
+	}
+
+	// Client: only saved uploads count
+	q = NewQuotas(QuotaConfig{ClientQuota: 300})
+	u, _ = q.Begin(client, filepath.Join(dir, "a.bin"))
+	u.Grow(200)
+	u.End(true)
+	u, _ = q.Begin(client, filepath.Join(dir, "b.bin"))
+	if err := u.Grow(101); err == nil {
+		t.Errorf("quota-client: expected error past the limit")
+	}
+	if u, _ := q.Begin(net.IPv4(10, 0, 0, 6), filepath.Join(dir, "a.bin")); u.Grow(300) != nil {
+		t.Errorf("quota-client: another client should have its own quota")
+	}
+
+	// Client: uploads still in flight count too
+	q = NewQuotas(QuotaConfig{ClientQuota: 300})
+	u, _ = q.Begin(client, filepath.Join(dir, "a.bin"))
+	u.Grow(200)
+	if other, _ := q.Begin(client, filepath.Join(dir, "b.bin")); other.Grow(101) == nil {
+		t.Errorf("quota-client: expected error, as in-flight uploads count")
+	}
+	u.End(false)
+
+	// Directory: the walked size is kept, saved uploads added to it without walking again
+	q = NewQuotas(QuotaConfig{DirQuotas: map[string]int64{dir: 1500}})
+	u, _ = q.Begin(client, filepath.Join(dir, "new.bin"))
+	u.Grow(400)
+	u.End(true)
+	if other, _ := q.Begin(client, filepath.Join(dir, "other.bin")); other.Grow(101) == nil {
+		t.Errorf("quota-dir: expected the saved upload to count")
+	}
+	u, _ = q.Begin(client, filepath.Join(dir, "existing.bin"))
+	u.Grow(500)
+	u.End(true)
+	if total := q.dirUsage[dir].total; total != 900 {
+		t.Errorf("quota-dir: expected 900 bytes used after replacing existing.bin; got %d", total)
+	}
+
+	// Free space: nobody has an exabyte spare
+	q = NewQuotas(QuotaConfig{MinFree: 1 << 60})
+	if _, err := q.Begin(client, filepath.Join(dir, "a.bin")); err == nil && diskFreeKnown(t, dir) {
+		t.Errorf("min-free: expected error")
+	}
+}
+
+func TestQuotaAbortsUpload(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "firmware.bin")
+	original := []byte("the original firmware")
+	os.WriteFile(filename, original, 0644)
+
+	nexus := NewFileNexus()
+	server := startServer(t, nexus)
+
+	t.Cleanup(func() { quotas.SetConfig(QuotaConfig{}) })
+	quotas.SetConfig(QuotaConfig{MaxFileSize: 4 * MaxDataBlockSize})
+
+	err := tftpPut(server, filename, make([]byte, 10*MaxDataBlockSize))
+	if err == nil || !strings.Contains(err.Error(), "code:[3]") {
+		t.Fatalf("expected ErrorDiskFull; got %v", err)
+	}
+
+	// Partial data is gone: the file on disk and what's served are still the original
+	if data, _ := os.ReadFile(filename); !bytes.Equal(data, original) {
+		t.Errorf("file on disk changed: %q", data)
+	}
+	if data, err := tftpGet(server, filename); err != nil || !bytes.Equal(data, original) {
+		t.Errorf("served file changed: %q, err:%v", data, err)
+	}
+}
+
+func diskFreeKnown(t *testing.T, dir string) bool {
+	free, err := diskFree(dir)
+	return err == nil && free >= 0
+}
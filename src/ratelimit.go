@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateClientIdle is how long a client's bucket is kept after its last block, once it owes nothing
+const rateClientIdle = time.Minute
+
+// rateLimiter paces DATA sends and ACKs, it is unlimited until configured
+var rateLimiter = NewRateLimiter()
+
+// TokenBucket allows rate bytes/sec on average, bursting up to burst bytes (~30ms worth) after being idle
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates the struct, it starts empty so the first second is already paced
+func NewTokenBucket(rate int64) *TokenBucket {
+	b := &TokenBucket{last: time.Now()}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate (bytes/sec) of the bucket, 0 is unlimited
+func (b *TokenBucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = float64(rate)
+	b.burst = b.rate / 32
+	if b.burst < MaxDataBlockSize {
+		b.burst = MaxDataBlockSize
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Rate returns the rate (bytes/sec) of the bucket, 0 is unlimited
+func (b *TokenBucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// reserve takes n tokens, going into debt if need be, and returns how long to wait before using them
+func (b *TokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// settled reports whether the bucket has been idle since before cutoff, with its debt paid off: dropping it then
+// only makes the next transfer start from an empty bucket
+func (b *TokenBucket) settled(cutoff time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.last.After(cutoff) {
+		return false
+	}
+	return b.rate <= 0 || b.tokens+time.Since(b.last).Seconds()*b.rate >= 0
+}
+
+// fileBucket is a rate shared by every transfer of a file matching pattern (path.Match glob)
+type fileBucket struct {
+	pattern string
+	bucket  *TokenBucket
+}
+
+// RateLimiter holds the global, per-client IP and per-file glob limits
+type RateLimiter struct {
+	global *TokenBucket
+
+	mu         sync.Mutex
+	clientRate int64
+	clients    map[string]*TokenBucket
+	pruned     time.Time    // when clients was last swept of idle buckets
+	files      []fileBucket // sorted by pattern
+}
+
+// RateLimits are the configured limits in bytes/sec, 0 is unlimited
+type RateLimits struct {
+	Global int64            `json:"global"`
+	Client int64            `json:"client"`
+	Files  map[string]int64 `json:"files"`
+}
+
+// NewRateLimiter creates the struct, with no limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		global:  NewTokenBucket(0),
+		clients: make(map[string]*TokenBucket),
+	}
+}
+
+// SetLimits replaces all limits, transfers in progress pick them up at their next block
+func (r *RateLimiter) SetLimits(limits RateLimits) {
+
+	r.global.SetRate(limits.Global)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clientRate = limits.Client
+	for _, bucket := range r.clients {
+		bucket.SetRate(limits.Client)
+	}
+
+	// Keep existing buckets (and their debt) for globs that are still configured
+	files := make([]fileBucket, 0, len(limits.Files))
+	for pattern, rate := range limits.Files {
+		if rate <= 0 {
+			continue
+		}
+		var bucket *TokenBucket
+		for _, fb := range r.files {
+			if fb.pattern == pattern {
+				bucket = fb.bucket
+				bucket.SetRate(rate)
+			}
+		}
+		if bucket == nil {
+			bucket = NewTokenBucket(rate)
+		}
+		files = append(files, fileBucket{pattern, bucket})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].pattern < files[j].pattern })
+	r.files = files
+}
+
+// Limits returns the configured limits
+func (r *RateLimiter) Limits() RateLimits {
+
+	limits := RateLimits{Global: r.global.Rate(), Files: make(map[string]int64)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limits.Client = r.clientRate
+	for _, fb := range r.files {
+		limits.Files[fb.pattern] = fb.bucket.Rate()
+	}
+	return limits
+}
+
+// Wait blocks until n bytes may be moved for client and filename, under every limit that applies (every
+// matching glob too, so the tightest of overlapping globs wins)
+func (r *RateLimiter) Wait(client *net.UDPAddr, filename string, n int) {
+
+	buckets := []*TokenBucket{r.global}
+
+	r.mu.Lock()
+	r.prune()
+	if r.clientRate > 0 {
+		ip := client.IP.String()
+		bucket, ok := r.clients[ip]
+		if !ok {
+			bucket = NewTokenBucket(r.clientRate)
+			r.clients[ip] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	// Names are matched without a leading '/', as the client may or may not have sent one (see AuthKey.allows)
+	name := strings.TrimLeft(path.Clean("/"+filename), "/")
+	for _, fb := range r.files {
+		if matched, _ := path.Match(strings.TrimLeft(fb.pattern, "/"), name); matched {
+			buckets = append(buckets, fb.bucket)
+		}
+	}
+	r.mu.Unlock()
+
+	var wait time.Duration
+	for _, bucket := range buckets {
+		if d := bucket.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// prune drops the buckets of clients idle for rateClientIdle, at most once per rateClientIdle; the caller
+// holds the lock
+func (r *RateLimiter) prune() {
+
+	now := time.Now()
+	if now.Sub(r.pruned) < rateClientIdle {
+		return
+	}
+	r.pruned = now
+
+	for ip, bucket := range r.clients {
+		if bucket.settled(now.Add(-rateClientIdle)) {
+			delete(r.clients, ip)
+		}
+	}
+}
+
+// ParseFileRates parses "glob=rate" pairs, as given to --rate-file
+func ParseFileRates(specs []string) (map[string]int64, error) {
+
+	rates := make(map[string]int64)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("ParseFileRates(): expected glob=rate, got:[%s]", spec)
+		}
+		if _, err := path.Match(spec[:i], ""); err != nil {
+			return nil, fmt.Errorf("ParseFileRates(): bad glob:[%s]", spec[:i])
+		}
+		rate, err := ParseByteSize(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rates[spec[:i]] = rate
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimitLoopback(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "limited.img")
+	size := 96 * 1024
+	if err := os.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, NewFileNexus())
+
+	tests := []struct {
+		name   string
+		limits RateLimits
+		rate   float64
+	}{
+		{"global", RateLimits{Global: 128 * 1024}, 128 * 1024},
+		{"client", RateLimits{Client: 192 * 1024}, 192 * 1024},
+		{"file", RateLimits{Files: map[string]int64{filepath.Join(dir, "*.img"): 160 * 1024}}, 160 * 1024},
+		{"tightest wins", RateLimits{Global: 512 * 1024, Client: 128 * 1024}, 128 * 1024},
+	}
+
+	t.Cleanup(func() { rateLimiter.SetLimits(RateLimits{}) })
+	for _, test := range tests {
+		rateLimiter.SetLimits(test.limits)
+
+		start := time.Now()
+		data, err := tftpGet(server, filename)
+		elapsed := time.Since(start).Seconds()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(data) != size {
+			t.Fatalf("%s: expected %d bytes; got %d", test.name, size, len(data))
+		}
+
+		achieved := float64(size) / elapsed
+		if achieved > test.rate*1.1 || achieved < test.rate*0.5 {
+			t.Errorf("%s: limit %.0f bytes/sec; achieved %.0f bytes/sec", test.name, test.rate, achieved)
+		}
+	}
+
+	// Writes are paced by their ACKs
+	rateLimiter.SetLimits(RateLimits{Global: 128 * 1024})
+	start := time.Now()
+	if err := tftpPut(server, filepath.Join(dir, "upload.img"), make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if achieved := float64(size) / time.Since(start).Seconds(); achieved > 128*1024*1.1 {
+		t.Errorf("write: limit %d bytes/sec; achieved %.0f bytes/sec", 128*1024, achieved)
+	}
+}
+
+func TestRateLimitOverlapAndPrune(t *testing.T) {
+	r := NewRateLimiter()
+
+	// Overlapping globs: both apply, so the tighter one sets the pace whichever order they're in
+	r.SetLimits(RateLimits{Files: map[string]int64{"images/*": 1024 * 1024, "images/*.img": 64 * 1024}})
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		r.Wait(client, "images/board.img", MaxDataBlockSize)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected 32k at 64k/sec to take ~500ms; took %s", elapsed)
+	}
+
+	// Idle clients that owe nothing are forgotten, the others kept
+	r.SetLimits(RateLimits{Client: 1024 * 1024})
+	for i := 1; i <= 3; i++ {
+		r.Wait(&net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i))}, "x", MaxDataBlockSize)
+	}
+	r.mu.Lock()
+	for ip, bucket := range r.clients {
+		if ip != "10.0.1.3" {
+			bucket.mu.Lock()
+			bucket.last = bucket.last.Add(-2 * rateClientIdle)
+			bucket.mu.Unlock()
+		}
+	}
+	r.pruned = time.Time{}
+	r.mu.Unlock()
+	r.Wait(&net.UDPAddr{IP: net.IPv4(10, 0, 1, 4)}, "x", MaxDataBlockSize)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.clients["10.0.1.1"]; ok || len(r.clients) != 2 {
+		t.Errorf("expected only 10.0.1.3 and 10.0.1.4 kept; got %v", r.clients)
+	}
+}
+
+func TestRateLimitUnderRoot(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "images"), 0755)
+	size := 32 * 1024
+	os.WriteFile(filepath.Join(dir, "images", "board.img"), make([]byte, size), 0644)
+
+	// Globs are matched against the name under the client's root, not the path on disk
+	t.Cleanup(func() {
+		vroots = nil
+		rateLimiter.SetLimits(RateLimits{})
+	})
+	vroots = NewVirtualRoots([]VirtualRoot{{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, Dir: dir}})
+	rateLimiter.SetLimits(RateLimits{Files: map[string]int64{"images/*.img": 64 * 1024}})
+	server := startServer(t, NewFileNexus())
+
+	start := time.Now()
+	if _, err := tftpGet(server, "/images/board.img"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected 32k at 64k/sec to take ~500ms; took %s", elapsed)
+	}
+}
+
+func TestRateLimitNames(t *testing.T) {
+	r := NewRateLimiter()
+	r.SetLimits(RateLimits{Files: map[string]int64{"images/*.img": 64 * 1024}})
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+
+	// Without a root the name is as the client sent it, a leading '/' or "./" still matches
+	for _, name := range []string{"/images/board.img", "./images/board.img"} {
+		start := time.Now()
+		for i := 0; i < 64; i++ {
+			r.Wait(client, name, MaxDataBlockSize)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("%s: expected 32k at 64k/sec to take ~500ms; took %s", name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// maxRewriteSteps stops rules that restart ('s') each other forever
+const maxRewriteSteps = 1000
+
+// rewriter maps requested filenames to files, nil when there are no rules
+var rewriter *Rewriter
+
+// Rewriter applies rules in the format of a tftpd-hpa remap file (see README) to requested filenames
+type Rewriter struct {
+	Backslash bool // turn '\' into '/' before the rules, for Windows-style paths
+	rules     []rewriteRule
+}
+
+// rewriteRule is one "flags regex [replacement]" line
+type rewriteRule struct {
+	line    int
+	flags   string
+	re      *regexp.Regexp
+	replace string
+	subnets []*net.IPNet // from the [subnet ...] section the rule is in, nil for every client
+}
+
+// LoadRewriter reads a remap file
+func LoadRewriter(path string) (*Rewriter, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRewriter(): path:[%s] err.Error():[%s]", path, err.Error())
+	}
+	defer file.Close()
+
+	rw, err := ParseRewriter(file)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRewriter(): path:[%s] %s", path, err.Error())
+	}
+
+	return rw, nil
+}
+
+// ParseRewriter parses remap rules, one per line: blank lines and '#' comments are skipped, and a
+// "[10.0.0.0/8 fd00::/8]" line makes the rules after it apply only to clients in those subnets ("[*]" for all)
+func ParseRewriter(r io.Reader) (*Rewriter, error) {
+
+	rw := &Rewriter{}
+	var subnets []*net.IPNet
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Section: the client subnets for the rules that follow
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			subnets = nil
+			for _, field := range strings.Fields(line[1 : len(line)-1]) {
+				if field == "*" {
+					subnets = nil
+					break
+				}
+				_, subnet, err := net.ParseCIDR(field)
+				if err != nil {
+					return nil, fmt.Errorf("line:[%d] err.Error():[%s]", n, err.Error())
+				}
+				subnets = append(subnets, subnet)
+			}
+			continue
+		}
+
+		fields := splitEscaped(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line:[%d] expected: flags regex [replacement], got:[%s]", n, line)
+		}
+		rule := rewriteRule{line: n, flags: fields[0], subnets: subnets}
+		if strings.Trim(rule.flags, "rgiesa~46GP-") != "" {
+			return nil, fmt.Errorf("line:[%d] unknown flags:[%s]", n, rule.flags)
+		}
+		if len(fields) == 3 {
+			rule.replace = fields[2]
+		} else if rule.has('r') {
+			return nil, fmt.Errorf("line:[%d] flag r needs a replacement", n)
+		}
+
+		expr := fields[1]
+		if rule.has('i') {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line:[%d] err.Error():[%s]", n, err.Error())
+		}
+		rule.re = re
+
+		rw.rules = append(rw.rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// Rewrite returns the filename to use for a request (op OpRRQ/OpWRQ) from client, or an error if a rule denies it
+func (rw *Rewriter) Rewrite(filename string, client net.IP, op uint16) (string, error) {
+
+	if rw == nil {
+		return filename, nil
+	}
+	if rw.Backslash {
+		filename = strings.ReplaceAll(filename, "\\", "/")
+	}
+
+	steps := 0
+	for i := 0; i < len(rw.rules); i++ {
+
+		if steps++; steps > maxRewriteSteps {
+			return "", fmt.Errorf("Rewrite(): rules loop, after line:[%d]", rw.rules[i].line)
+		}
+
+		rule := &rw.rules[i]
+		if !rule.applies(client, op) {
+			continue
+		}
+
+		matches := rule.re.FindAllStringSubmatchIndex(filename, 1)
+		if rule.has('g') {
+			matches = rule.re.FindAllStringSubmatchIndex(filename, -1)
+		}
+		if (len(matches) > 0) == rule.has('~') {
+			continue
+		}
+
+		if rule.has('a') {
+			return "", fmt.Errorf("Access denied by rewrite rule on line %d", rule.line)
+		}
+		if rule.has('r') && len(matches) > 0 {
+			filename = rule.substitute(filename, matches, client)
+		}
+		if rule.has('s') {
+			i = -1
+			continue
+		}
+		if rule.has('e') {
+			break
+		}
+	}
+
+	return filename, nil
+}
+
+func (rule *rewriteRule) has(flag byte) bool {
+	return strings.IndexByte(rule.flags, flag) >= 0
+}
+
+// applies is whether the rule is for the op ('G' RRQ only, 'P' WRQ only), IP family ('4', '6') and subnet
+func (rule *rewriteRule) applies(client net.IP, op uint16) bool {
+
+	switch {
+	case rule.has('G') && op != OpRRQ,
+		rule.has('P') && op != OpWRQ,
+		rule.has('4') && client.To4() == nil,
+		rule.has('6') && client.To4() != nil:
+		return false
+	}
+
+	if rule.subnets == nil {
+		return true
+	}
+	for _, subnet := range rule.subnets {
+		if subnet.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// substitute replaces each match with the replacement: \0 is the match, \1 .. \9 groups,
+// \i the client IP, \x the client IP in hex, and any other \c is c
+func (rule *rewriteRule) substitute(filename string, matches [][]int, client net.IP) string {
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(filename[last:m[0]])
+		for i := 0; i < len(rule.replace); i++ {
+			c := rule.replace[i]
+			if c != '\\' || i+1 == len(rule.replace) {
+				b.WriteByte(c)
+				continue
+			}
+			i++
+			switch c = rule.replace[i]; {
+			case c >= '0' && c <= '9':
+				if g := int(c - '0'); 2*g+1 < len(m) && m[2*g] >= 0 {
+					b.WriteString(filename[m[2*g]:m[2*g+1]])
+				}
+			case c == 'i':
+				b.WriteString(client.String())
+			case c == 'x':
+				ip := client.To4()
+				if ip == nil {
+					ip = client.To16()
+				}
+				fmt.Fprintf(&b, "%X", []byte(ip))
+			default:
+				b.WriteByte(c)
+			}
+		}
+		last = m[1]
+	}
+	b.WriteString(filename[last:])
+
+	return b.String()
+}
+
+// splitEscaped splits a line on whitespace, except where escaped with '\' (other escapes are kept)
+func splitEscaped(line string) []string {
+
+	var fields []string
+	var cur strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '\t'):
+			i++
+			cur.WriteByte(line[i])
+		case c == '\\' && i+1 < len(line):
+			cur.WriteByte(c)
+			i++
+			cur.WriteByte(line[i])
+		case c == ' ' || c == '\t':
+			if cur.Len() > 0 {
+				fields = append(fields, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+
+	return fields
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRemap = `
+# Old firmware asks for /tftpboot/..., new for the bare name
+r	^/tftpboot/	/srv/tftp/
+ri	^pxelinux\.0$	/srv/tftp/pxelinux.0
+rg	\.\.	.
+a	^/etc/
+G	^/srv/tftp/(uploads)/	\0
+rP	^([^/]+)$	/srv/tftp/uploads/\i-\1
+
+[10.1.0.0/16]
+re	^/srv/tftp/pxelinux\.0$	/srv/tftp/lab/pxelinux.0
+[*]
+r	^/srv/tftp/lab/	/srv/tftp/lab/\x/
+`
+
+func TestRewrite(t *testing.T) {
+	rw, err := ParseRewriter(strings.NewReader(testRemap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw.Backslash = true
+
+	office, lab := net.IPv4(192, 168, 0, 9), net.IPv4(10, 1, 2, 3)
+	tests := []struct {
+		filename string
+		client   net.IP
+		op       uint16
+		expected string
+	}{
+		{"/tftpboot/pxelinux.0", office, OpRRQ, "/srv/tftp/pxelinux.0"},
+		{"PXELINUX.0", office, OpRRQ, "/srv/tftp/pxelinux.0"},
+		{"boot\\pxelinux.0", office, OpRRQ, "boot/pxelinux.0"},
+		{"/tftpboot/a..b..c", office, OpRRQ, "/srv/tftp/a.b.c"},
+		{"core", office, OpWRQ, "/srv/tftp/uploads/192.168.0.9-core"},
+		{"core", office, OpRRQ, "core"},
+		{"/etc/passwd", office, OpRRQ, ""},
+
+		// Per subnet: the lab rule ends ('e') before the rule for everyone
+		{"pxelinux.0", lab, OpRRQ, "/srv/tftp/lab/pxelinux.0"},
+		{"/srv/tftp/lab/x", lab, OpRRQ, "/srv/tftp/lab/0A010203/x"},
+	}
+	for _, test := range tests {
+		actual, err := rw.Rewrite(test.filename, test.client, test.op)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected denied; got %q", test.filename, actual)
+			}
+			continue
+		}
+		if err != nil || actual != test.expected {
+			t.Errorf("%s from %s: expected %q; got %q, err:%v", test.filename, test.client, test.expected, actual, err)
+		}
+	}
+
+	for _, bad := range []string{"x ^a b", "r ^a", "r ( b", "[10.0.0.0/33]"} {
+		if _, err := ParseRewriter(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestRewriteServed(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pxelinux.0"), []byte("boot me"), 0644)
+
+	t.Cleanup(func() { rewriter = nil })
+	rewriter, _ = ParseRewriter(strings.NewReader(`ri ^(/tftpboot/)?(boot/)?(.*)$ ` + dir + `/\3`))
+	rewriter.Backslash = true
+	server := startServer(t, NewFileNexus())
+
+	for _, filename := range []string{"/TFTPBOOT/pxelinux.0", "pxelinux.0", "boot\\pxelinux.0"} {
+		data, err := tftpGet(server, filename)
+		if err != nil || string(data) != "boot me" {
+			t.Errorf("%s: expected %q; got %q, err:%v", filename, "boot me", data, err)
+		}
+	}
+}
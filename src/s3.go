@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 defaults: ranged GETs of 1 MiB, multipart parts of 8 MiB (S3's minimum is 5 MiB, except the last)
+const (
+	s3ChunkSize = 1 << 20
+	s3PartSize  = 8 << 20
+)
+
+// Uploader is a Backend that takes uploads, WRQs go to it instead of the local disk
+type Uploader interface {
+	Upload(ctx context.Context, name string) (BackendUpload, error)
+}
+
+// BackendUpload receives a file as it arrives, it only appears on the backend once committed
+type BackendUpload interface {
+	Write(p []byte) (int, error)
+	Commit() error
+	Abort() error
+}
+
+// S3Backend is an S3-compatible bucket (AWS, MinIO, ...), addressed path-style as endpoint/bucket/prefix/name
+type S3Backend struct {
+	Endpoint  *url.URL
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+
+	ChunkSize int64 // bytes per ranged GET
+	PartSize  int   // bytes per multipart part
+}
+
+// NewS3Backend creates the struct for "s3://bucket/prefix", the endpoint, region and credentials come
+// from AWS_ENDPOINT_URL, AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+func NewS3Backend(spec string) (*S3Backend, error) {
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("NewS3Backend(): expected s3://bucket/prefix, got:[%s]", spec)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil || e.Host == "" {
+		return nil, fmt.Errorf("NewS3Backend(): invalid AWS_ENDPOINT_URL:[%s]", endpoint)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = backendHeaderTimeout
+
+	return &S3Backend{
+		Endpoint:  e,
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Client:    &http.Client{Transport: transport},
+		ChunkSize: s3ChunkSize,
+		PartSize:  s3PartSize,
+	}, nil
+}
+
+// objectURL is the URL of an object, with a query (already in canonical order, see s3Query)
+func (s *S3Backend) objectURL(name string, query string) *url.URL {
+	u := *s.Endpoint
+	u.Path = "/" + path.Join(s.Bucket, s.Prefix, name)
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = query
+	return &u
+}
+
+// do signs and sends a request, body may be nil
+func (s *S3Backend) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now())
+
+	return s.Client.Do(req)
+}
+
+// Fetch reads an object with ranged GETs of ChunkSize, each further range only if the object hasn't changed
+func (s *S3Backend) Fetch(ctx context.Context, name string, cached *BackendResponse) (*BackendResponse, error) {
+
+	u := s.objectURL(name, "")
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=0-%d", s.ChunkSize-1))
+	if cached != nil && cached.ETag != "" {
+		header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, u, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return &BackendResponse{NotModified: true}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrBackendNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Only an empty object has no first byte
+		resp.Body.Close()
+		return &BackendResponse{Body: io.NopCloser(bytes.NewReader(nil)), Size: 0}, nil
+	case http.StatusOK:
+		// The whole object, the range was ignored
+		return &BackendResponse{Body: resp.Body, Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+	case http.StatusPartialContent:
+	default:
+		return nil, s3Error("S3Backend.Fetch()", u, resp)
+	}
+
+	// Content-Range: bytes 0-1048575/5242880
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3Backend.Fetch(): url:[%s] invalid Content-Range:[%s]", u, resp.Header.Get("Content-Range"))
+	}
+	etag := resp.Header.Get("ETag")
+
+	reader := &s3RangeReader{s: s, ctx: ctx, u: u, etag: etag, size: size, body: resp.Body, end: resp.ContentLength}
+	return &BackendResponse{Body: reader, Size: size, ETag: etag}, nil
+}
+
+// s3RangeReader reads an object a range at a time
+type s3RangeReader struct {
+	s    *S3Backend
+	ctx  context.Context
+	u    *url.URL
+	etag string
+	size int64
+	pos  int64 // read so far
+	end  int64 // end of the current range
+	body io.ReadCloser
+}
+
+func (r *s3RangeReader) Read(p []byte) (int, error) {
+
+	for {
+		if r.body != nil {
+			n, err := r.body.Read(p)
+			r.pos += int64(n)
+			if errors.Is(err, io.EOF) {
+				r.body.Close()
+				r.body = nil
+				if r.pos < r.end {
+					return n, io.ErrUnexpectedEOF
+				}
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+		}
+		if r.pos >= r.size {
+			return 0, io.EOF
+		}
+
+		// Next range, of the same version of the object
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.pos, min(r.pos+r.s.ChunkSize, r.size)-1))
+		if r.etag != "" {
+			header.Set("If-Match", r.etag)
+		}
+		resp, err := r.s.do(r.ctx, http.MethodGet, r.u, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			return 0, s3Error("s3RangeReader.Read()", r.u, resp)
+		}
+		r.body = resp.Body
+		r.end = r.pos + resp.ContentLength
+	}
+}
+
+func (r *s3RangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// s3UploadQueue is how many full parts an upload may have waiting for the bucket, besides the one being sent;
+// only once they are all taken does a WRQ (and so its next ACK) wait for the bucket
+const s3UploadQueue = 2
+
+// Upload starts an upload of name: a PUT if it fits in one part, a multipart upload otherwise
+func (s *S3Backend) Upload(ctx context.Context, name string) (BackendUpload, error) {
+	return &s3Upload{s: s, ctx: ctx, name: name}, nil
+}
+
+// s3Upload sends each part as it fills, the multipart upload is created with the first one; parts are sent in
+// the background, in order, so a slow bucket doesn't hold up the WRQ's ACKs
+type s3Upload struct {
+	s    *S3Backend
+	ctx  context.Context
+	name string
+	buf  []byte
+
+	queue  chan []byte   // full parts for the sender, nil until the first one
+	sent   chan struct{} // closed once the sender is done with the queue
+	closed bool
+
+	mu      sync.Mutex
+	err     error // the first part that failed, the rest are dropped
+	aborted bool  // the parts still queued are dropped
+
+	// Set by the sender, read once it is done
+	uploadID string
+	parts    []s3Part
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (up *s3Upload) Write(p []byte) (int, error) {
+
+	up.buf = append(up.buf, p...)
+	for len(up.buf) >= up.s.PartSize {
+		if err := up.queuePart(up.buf[:up.s.PartSize]); err != nil {
+			return 0, err
+		}
+		up.buf = append([]byte(nil), up.buf[up.s.PartSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// queuePart hands a part to the sender, starting it for the first; it fails once a part has
+func (up *s3Upload) queuePart(data []byte) error {
+
+	if up.queue == nil {
+		up.queue, up.sent = make(chan []byte, s3UploadQueue), make(chan struct{})
+		go up.send()
+	}
+	if err := up.failed(); err != nil {
+		return err
+	}
+	up.queue <- data
+
+	return nil
+}
+
+// send uploads the queued parts until the queue is closed, dropping them after a failure or an abort
+func (up *s3Upload) send() {
+
+	defer close(up.sent)
+	for data := range up.queue {
+		up.mu.Lock()
+		skip := up.err != nil || up.aborted
+		up.mu.Unlock()
+		if skip {
+			continue
+		}
+		if err := up.sendPart(data); err != nil {
+			up.mu.Lock()
+			up.err = err
+			up.mu.Unlock()
+		}
+	}
+}
+
+// failed is the error of the first part that failed, nil if none has
+func (up *s3Upload) failed() error {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.err
+}
+
+// finish closes the queue and waits for the sender, returning the first error
+func (up *s3Upload) finish() error {
+
+	if up.queue == nil {
+		return nil
+	}
+	if !up.closed {
+		close(up.queue)
+		up.closed = true
+	}
+	<-up.sent
+
+	return up.failed()
+}
+
+// sendPart uploads the next part, creating the multipart upload for the first; it runs in the sender
+func (up *s3Upload) sendPart(data []byte) error {
+
+	if up.uploadID == "" {
+		u := up.s.objectURL(up.name, "uploads=")
+		resp, err := up.s.do(up.ctx, http.MethodPost, u, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := s3Decode("s3Upload.sendPart()", u, resp, &result); err != nil {
+			return err
+		}
+		up.uploadID = result.UploadID
+	}
+
+	number := len(up.parts) + 1
+	u := up.s.objectURL(up.name, s3Query(map[string]string{"partNumber": strconv.Itoa(number), "uploadId": up.uploadID}))
+	resp, err := up.s.do(up.ctx, http.MethodPut, u, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("s3Upload.sendPart()", u, resp)
+	}
+	up.parts = append(up.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+	return nil
+}
+
+// Commit sends what's left and waits for the parts still queued, the object appears on the bucket now
+func (up *s3Upload) Commit() error {
+
+	if up.queue == nil {
+		u := up.s.objectURL(up.name, "")
+		resp, err := up.s.do(up.ctx, http.MethodPut, u, nil, up.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return s3Error("s3Upload.Commit()", u, resp)
+		}
+		return nil
+	}
+
+	if len(up.buf) > 0 {
+		if err := up.queuePart(up.buf); err != nil {
+			return err
+		}
+		up.buf = nil
+	}
+	if err := up.finish(); err != nil {
+		return err
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: up.parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	u := up.s.objectURL(up.name, s3Query(map[string]string{"uploadId": up.uploadID}))
+	resp, err := up.s.do(up.ctx, http.MethodPost, u, nil, body)
+	if err != nil {
+		return err
+	}
+	return s3Decode("s3Upload.Commit()", u, resp, &struct{}{})
+}
+
+// Abort drops the parts sent so far (once the one being sent is done) and those still queued, nothing appears on
+// the bucket
+func (up *s3Upload) Abort() error {
+
+	up.mu.Lock()
+	up.aborted = true
+	up.mu.Unlock()
+	up.finish()
+
+	if up.uploadID == "" {
+		return nil
+	}
+	u := up.s.objectURL(up.name, s3Query(map[string]string{"uploadId": up.uploadID}))
+	resp, err := up.s.do(up.ctx, http.MethodDelete, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("s3Upload.Abort()", u, resp)
+	}
+
+	return nil
+}
+
+// s3Decode reads an XML response, S3 may answer 200 with an <Error> body
+func s3Decode(where string, u *url.URL, resp *http.Response, result any) error {
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("%s: url:[%s] status:[%s] body:[%s]", where, u, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return xml.Unmarshal(body, result)
+}
+
+func s3Error(where string, u *url.URL, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: url:[%s] status:[%s] body:[%s]", where, u, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header, signing host, range and the x-amz-* headers
+func (s *S3Backend) sign(req *http.Request, body []byte, now time.Time) {
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Canonical headers: lower case names, sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query is a query string in SigV4 canonical form: sorted, and escaped as in s3Escape
+func s3Query(params map[string]string) string {
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = s3Escape(k) + "=" + s3Escape(params[k])
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3EscapePath escapes each segment of a path, keeping the '/'
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Escape percent-encodes all but the RFC3986 unreserved characters, as SigV4 requires
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,66 +1,111 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// MaxRetries is how many times a DATA/ACK is re-sent after a timeout, before giving up on the client
+const MaxRetries = 5
+
 // SetupListener will establish a listener on the given Server IP/Port
 func SetupListener(serverIPPort string) *net.UDPConn {
 
 	addr, err := net.ResolveUDPAddr("udp", serverIPPort)
 	if err != nil {
-		logFatal.Printf("ResolveUDPAddr()::serverIPPort:[%s]::err.Error():[%s]\n", serverIPPort, err.Error())
+		logger.Error("listener: unable to resolve address", "addr", serverIPPort, "err", err)
 		os.Exit(1)
 	}
 
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		logFatal.Printf("ListenUDP()::addr:[%s]::err.Error():[%s]\n", addr, err.Error())
+		logger.Error("listener: unable to listen", "addr", addr.String(), "err", err)
 		os.Exit(2)
 	}
 
-	logInfo.Printf("Listener: %s\n", serverIPPort)
+	logger.Info("listener: bound", "addr", serverIPPort)
 
 	return conn
 }
 
-// ListenAndServe is the engine for the tftp-server
-func ListenAndServe(serverIPPort string, numThreads int, timeout int) {
+// Serve is the engine for the tftp-server, running on an already established listener
+func Serve(conn *net.UDPConn, nexus *FileNexus, numThreads int, timeout int) {
 
-	// Listener Start
-	conn := SetupListener(serverIPPort)
+	// Learn the destination address of each request, so replies leave from the address the client used
+	if err := enablePacketInfo(conn); err != nil {
+		logger.Error("listener: unable to enable packet info", "err", err)
+	}
 
 	// Create a *buffered* channel = # of threads, as one thread per channel to prevent blocks/dropped data
 	dataChannel := make(chan RawPacket, numThreads)
+
+	// Once the listener is closed, let the threads finish the transfers they have before returning
+	var workers sync.WaitGroup
+	defer workers.Wait()
 	defer close(dataChannel)
 
-	// Central repo for File data and mutexes
-	nexus := NewFileNexus()
+	// Saturation and cache gauges are sampled when scraped
+	metrics.SetWorkers(numThreads, dataChannel)
+	metrics.SetNexus(nexus)
 
 	// Create threads and pass the dataChannel
-	logInfo.Printf("Threads: %d Started", numThreads)
+	logger.Info("threads: started", "threads", numThreads)
 
 	for i := 0; i < numThreads; i++ {
-		go processProtocol(nexus, dataChannel, timeout)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			processProtocol(nexus, dataChannel, timeout)
+		}()
 	}
 
 	// Forever Loop...Listening
-	logInfo.Printf("Listener: Loop Running\n")
+	logger.Info("listener: loop running", "addr", conn.LocalAddr().String())
 	for {
 
 		// Make a new Buffer Each time, I wasn't, but I got weird concurrent issues
 		rcvBuf := make([]byte, MaxPacketSize)
+		oobBuf := make([]byte, packetInfoSize)
 
 		// Blocking read from Listener
-		cnt, remoteAddr, _ := conn.ReadFromUDP(rcvBuf)
+		cnt, oobCnt, _, remoteAddr, err := conn.ReadMsgUDP(rcvBuf, oobBuf)
+		if errors.Is(err, net.ErrClosed) {
+			logger.Info("listener: closed")
+			return
+		}
+		if err != nil {
+			logger.Error("listener: read failed", "err", err)
+			continue
+		}
+		// Only RRQ/WRQ belong on the listener port, anything else (DATA/ACK for a finished transfer,
+		// garbage) is dropped silently, it isn't worth a socket or a log line
+		if opcode, _, err := parseUint16(rcvBuf[:cnt]); err != nil || (opcode != OpRRQ && opcode != OpWRQ) {
+			metrics.Dropped(DropInvalid)
+			continue
+		}
+
+		// Flood protection: rate limited, over their outstanding cap or banned sources are dropped silently too
+		if ok, reason := guard.Admit(remoteAddr.IP); !ok {
+			metrics.Dropped(reason)
+			logger.Debug("request dropped", "client", remoteAddr.String(), "reason", reason)
+			continue
+		}
+
+		localIP, localZone := parsePacketInfo(oobBuf[:oobCnt])
 
 		// Bundle raw packet bytes with IP, as thread won't have access to "conn"
 		rawPacket := RawPacket{
-			Addr:  remoteAddr,
-			bytes: rcvBuf[:cnt],
+			Addr:      remoteAddr,
+			LocalAddr: &net.UDPAddr{IP: localIP, Zone: localZone},
+			bytes:     rcvBuf[:cnt],
 		}
 
 		// fan-out the bytes to the *buffered* channel for goroutines to process
@@ -69,17 +114,17 @@ func ListenAndServe(serverIPPort string, numThreads int, timeout int) {
 
 }
 
-func createUDPEndPoint(addr string, port int) (bool, *net.UDPAddr, *net.UDPConn) {
+func createUDPEndPoint(addr *net.UDPAddr, port int) (bool, *net.UDPAddr, *net.UDPConn) {
 
-	// Establish Connection
-	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
-	if err != nil {
-		logError.Printf("resolveUDPAddr()::err.Error():[%s]\n", err.Error())
-		return false, nil, nil
+	// Establish Connection, on the same local address the request arrived on (if known)
+	localAddr := &net.UDPAddr{Port: port}
+	if addr != nil {
+		localAddr.IP = addr.IP
+		localAddr.Zone = addr.Zone
 	}
 	conn, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		logError.Printf("listenUDP()::err.Error():[%s]\n", err.Error())
+		logger.Error("unable to create transfer endpoint", "addr", localAddr.String(), "err", err)
 		return false, localAddr, nil
 	}
 
@@ -89,86 +134,217 @@ func createUDPEndPoint(addr string, port int) (bool, *net.UDPAddr, *net.UDPConn)
 // processProtocol goroutine to process data received by main-thread and "fanned out"
 func processProtocol(nexus *FileNexus, dataChannel chan RawPacket, timeout int) {
 
-	for {
-
-		// read packet out of the channel to process
-		rawPacket := <-dataChannel
+	// read packet out of the channel to process
+	for rawPacket := range dataChannel {
 
-		success, _, conn := createUDPEndPoint("", 0)
+		success, _, conn := createUDPEndPoint(rawPacket.LocalAddr, 0)
 		if !success {
+			guard.Release(rawPacket.Addr.IP)
 			continue
 		}
 
+		metrics.WorkersBusy.Add(1)
+
 		// get raw bytes from packet
 		rawRequestBuffer := rawPacket.getBytes()
 
+		// Virtual Root: the directory this client (or the address it asked) is served from
+		root, rooted := vroots.Resolve(rawPacket.Addr.IP, rawPacket.LocalAddr.IP)
+
 		opcode, p, err := ParsePacket(rawRequestBuffer) // @TODO discarded err
-		if err == nil {
+		request, isRequest := p.(*PacketRequest)
+		if err == nil && isRequest && Paused() {
+			// Operator has paused new requests (see admin.go)
+			doRefuse(conn, rawPacket.Addr, *request, ErrorNotDefined, "Server is not accepting requests, try again later")
+		} else if err == nil && isRequest && !rooted {
+			doRefuse(conn, rawPacket.Addr, *request, ErrorFileAccessViolation, "No files are served to this client")
+		} else if err == nil {
 			switch opcode {
 			case OpRRQ:
 				// @TODO re-evaluate this..., do I need makePacketRequest, can I use wire.go?
 				packetReq := makePacketRequest(p.Serialize())
-				doReadReq(nexus, conn, rawPacket.Addr, packetReq)
+				doReadReq(nexus, conn, rawPacket.Addr, packetReq, root, timeout)
 			case OpWRQ:
 				// @TODO re-evaluate this..., do I need makePacketRequest, can I use wire.go?
 				packetReq := makePacketRequest(p.Serialize())
-				doWriteReq(nexus, conn, rawPacket.Addr, packetReq)
+				doWriteReq(nexus, conn, rawPacket.Addr, packetReq, root, timeout)
 			default:
-				logError.Printf("processProtocol()::Invalid Opcode::opcode:[%d]", opcode)
+				logger.Error("invalid opcode", "client", rawPacket.Addr.String(), "opcode", opcode)
 			}
 		} else {
-			logError.Printf("processProtocol()::ParsePacket()::err.Error():[%s]\n", err.Error())
+			logger.Error("unable to parse packet", "client", rawPacket.Addr.String(), "err", err)
 		}
 
 		// Close the connection as we are done processing the packet
 		conn.Close()
+		guard.Release(rawPacket.Addr.IP)
+		metrics.WorkersBusy.Add(-1)
+	}
+}
+
+// doRefuse refuses a request before it is looked at (server paused, no virtual root for the client), it is still a
+// transfer: logged, audited, counted as rejected and hooked, and its access violations earn strikes
+func doRefuse(conn *net.UDPConn, remoteAddr *net.UDPAddr, packet PacketRequest, code uint16, msg string) {
+
+	direction := DirectionRead
+	if packet.Op == OpWRQ {
+		direction = DirectionWrite
 	}
+	t := NewTransfer(conn, remoteAddr, direction, packet.Filename)
+	defer t.Finish()
+	t.Info("request refused", "mode", packet.Mode)
+	doSendError(t, code, msg)
 }
 
-// doSendError will send an error packet on conn to client
-func doSendError(conn *net.UDPConn, code uint16, msg string) {
-	logError.Printf("doSendError()::msg:[%s]\n", msg)
+// doSendError will send an error packet on the transfer's conn to client
+func doSendError(t *Transfer, code uint16, msg string) {
+	t.Error("sending error", "code", code, "msg", msg)
+	t.ErrorCode = int(code)
+	metrics.ErrorSent(code)
+
+	// Clients fishing for filenames (or paths they shouldn't have) earn strikes towards a ban
+	if code == ErrorFileNotFound || code == ErrorFileAccessViolation {
+		if guard.Strike(t.Client.IP) {
+			t.Info("client banned, too many failed requests")
+		}
+	}
 	p := NewPacketError(code, msg)
-	conn.Write(p.Serialize())
+	t.conn.WriteToUDP(p.Serialize(), t.Client)
 }
 
 // doValidateOpMode we only support binary aka octect at this time
-func doValidateOpMode(conn *net.UDPConn, mode string) bool {
+func doValidateOpMode(t *Transfer, mode string) bool {
 
 	if strings.Compare(strings.ToLower(mode), "octect") == 0 {
 		errmsg := fmt.Sprintf("ERROR: mode:[%s] is not supported.\n", mode)
-		logError.Printf(errmsg)
-		doSendError(conn, ErrorNotDefined, errmsg)
-		conn.Close()
+		doSendError(t, ErrorNotDefined, errmsg)
 		return false
 	}
 	return true
 }
 
+// doRewrite applies the rewrite rules to the requested filename, then maps it into the virtual root (t.Name keeps
+// the name under the root), refusing the request if a rule denies it
+func doRewrite(t *Transfer, packet *PacketRequest, root string) bool {
+
+	filename, err := rewriter.Rewrite(packet.Filename, t.Client.IP, packet.Op)
+	if err != nil {
+		doSendError(t, ErrorFileAccessViolation, err.Error())
+		return false
+	}
+	t.Name = filename
+	filename = underRoot(root, filename)
+	if root != "" {
+		t.Name = backendName(root, filename)
+	}
+	if filename != packet.Filename {
+		t.Info("rewritten", "target", filename)
+		packet.Filename = filename
+		t.Path = filename
+	}
+	return true
+}
+
 // doReadReq will process the incoming request packet and continue until file req processed
-func doReadReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, packet PacketRequest) {
+func doReadReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, packet PacketRequest, root string, timeout int) {
 
-	logInfo.Printf("READ: REQUEST file:[%s], client:[%s]\n", packet.Filename, remoteAddr.String())
+	t := NewTransfer(conn, remoteAddr, DirectionRead, packet.Filename)
+	defer t.Finish()
+	t.Info("request", "mode", packet.Mode)
 
 	// Validate OpMode
-	if !doValidateOpMode(conn, packet.Mode) {
+	if !doValidateOpMode(t, packet.Mode) {
 		return
 	}
 
-	// Load the File into Nexus
-	entry, err := nexus.GetEntry(conn, remoteAddr.String(), packet.Filename)
+	// Authentication: a request naming a key has to prove it has it
+	session, err := authKeys.Authenticate(OpRRQ, packet.Filename, packet.Options)
 	if err != nil {
-		logError.Printf("ERROR: doWriteReq()::GetEntry()::remoteAddr.String():[%s]::packet.Filename:[%s] err.Error():[%s]", remoteAddr.String(), packet.Filename, err.Error())
+		doSendError(t, ErrorFileAccessViolation, err.Error())
 		return
 	}
 
-	// File Exists?
-	if entry.Bytes == nil {
+	// Host Table: the file this client gets for the name it asked for
+	if file, ok := hostTable.Lookup(packet.Filename, remoteAddr.IP); ok {
+		t.Info("host table", "target", file)
+		packet.Filename = file
+		t.Path = file
+	}
+
+	// Rewrite Rules: the file the requested name maps to
+	if !doRewrite(t, &packet, root) {
+		return
+	}
+	if err := authKeys.Authorize(session, OpRRQ, t.Name); err != nil {
+		doSendError(t, ErrorFileAccessViolation, err.Error())
+		return
+	}
+
+	// Load the File into Nexus (or generate its checksum sidecar or directory listing, decompress its .gz/.zst, or
+	// fetch it from the backend)
+	entry, ok := sidecarEntry(nexus, remoteAddr.String(), packet.Filename)
+	if !ok {
+		entry, ok = listingEntry(t, session, root, packet.Filename)
+	}
+	if !ok {
+		if compressed, ok := compressedFile(packet.Filename); ok {
+			entry, err = nexus.GetCompressedEntry(remoteAddr.String(), packet.Filename, compressed)
+		} else if b := vroots.Backend(root); b != nil && !fileExists(packet.Filename) {
+			entry, err = nexus.GetBackendEntry(b, remoteAddr.String(), packet.Filename, backendName(root, packet.Filename))
+		} else {
+			entry, err = nexus.GetEntry(remoteAddr.String(), packet.Filename)
+		}
+		if err != nil {
+			doSendError(t, ErrorFileNotFound, err.Error())
+			return
+		}
+	}
+
+	// File Exists? (one downloading from the backend does, even before its first bytes arrive)
+	data, err := nexus.waitFor(t, entry, 0)
+	if err != nil {
+		doSendError(t, ErrorNotDefined, err.Error())
+		return
+	}
+	if data == nil {
 		errmsg := fmt.Sprintf("ERROR: Requested file does not exist, file:[%s]", packet.Filename)
-		doSendError(conn, ErrorFileNotFound, errmsg)
-		conn.Close()
+		doSendError(t, ErrorFileNotFound, errmsg)
 		return
 	}
+	t.Accept()
+
+	// Multicast (RFC2090): the file is sent to a group, shared by every client reading it at the same time (not
+	// for authenticated reads, the OACK is for one client)
+	if _, ok := packet.Options["multicast"]; ok && mcast != nil && session == nil {
+		if doMulticast(t, nexus, entry, conn, packet, timeout) {
+			return
+		}
+	}
+
+	// Options (RFC2347): answered with an OACK, which the client ACKs as block 0
+	var offset int
+	if len(packet.Options) > 0 {
+		var oack map[string]string
+		oack, offset, data, err = readOptions(t, nexus, entry, data, packet.Options)
+		if errors.Is(err, errOptionRefused) {
+			doSendError(t, ErrorOptionNegotiation, err.Error())
+			return
+		}
+		if err != nil {
+			doSendError(t, ErrorNotDefined, err.Error())
+			return
+		}
+		if session != nil {
+			if oack, data, err = session.readOACK(t, nexus, entry, oack); err != nil {
+				doSendError(t, ErrorNotDefined, err.Error())
+				return
+			}
+		}
+		if oack != nil && !doSendOAck(t, conn, remoteAddr, oack, timeout) {
+			return
+		}
+	}
+	t.SetSize(entry.expectedSize(data))
 
 	// Indicator for Success
 	var fileComplete bool = false
@@ -176,51 +352,87 @@ func doReadReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pac
 	// Create ACK Packet (Reusable)
 	ackPacket := PacketAck{}
 
-	// Loop through the entire file
+	// Loop through the entire file (from the offset a resumed transfer asked for)
 	var curBlock uint16 = 1
-	var curPos int = 0
+	var curPos int = offset
 
-	for curPos <= len(entry.Bytes) {
+	for curPos <= len(data) {
 
 		// Make a new Buffer Each time, I wasn't, but I got weird concurrent issues
 		ackBuffer := make([]byte, 4)
 
+		// A file still downloading from the backend is sent as it arrives, a short block means the end
+		data, err = nexus.waitFor(t, entry, curPos+MaxDataBlockSize)
+		if err != nil {
+			doSendError(t, ErrorNotDefined, err.Error())
+			return
+		}
+
 		// Set the PacketSize with bounds to the end of file
 		packetSize := MaxDataBlockSize
-		if curPos+packetSize > len(entry.Bytes) {
-			packetSize = len(entry.Bytes) - curPos
+		if curPos+packetSize > len(data) {
+			packetSize = len(data) - curPos
 		}
 
-		// fmt.Fprintf(os.Stdout, "DEBUG::READ: STATUS curPos:[%d] curBlock:[%d] packetSize:[%d] len(entry.Bytes):[%d]\n", curPos, curBlock, packetSize, len(entry.Bytes))
+		t.Debug("sending block", "block", curBlock, "pos", curPos, "size", packetSize)
+
+		// Pace the send, under the global/client/file rate limits
+		rateLimiter.Wait(remoteAddr, t.Name, packetSize)
 
 		// Send the Data Packet
-		dataPacket := makePacketData(curBlock, entry.Bytes, curPos, packetSize)
-		_, err := conn.WriteToUDP(dataPacket.Serialize(), remoteAddr)
+		dataPacket := makePacketData(curBlock, data, curPos, packetSize)
+		dataBuffer := dataPacket.Serialize()
+		_, err := conn.WriteToUDP(dataBuffer, remoteAddr)
+		metrics.BytesSent.Add(uint64(packetSize))
 		if err != nil {
 			errmsg := fmt.Sprintf("ERROR:[%s] doReadReq()::conn.WriteToUDP()::remoteAddr:[%s]", err.Error(), remoteAddr.String())
-			doSendError(conn, ErrorNotDefined, errmsg)
+			doSendError(t, ErrorNotDefined, errmsg)
 			return
 		}
 
 		// End of the Line! We just sent a ZERO byte packet, so that's the end of the transfer and we exit
-		// NOTE: We did this, cuz "for curPos <= len(entry.Bytes)", which got us here
-		if curPos == len(entry.Bytes) {
+		// NOTE: We did this, cuz "for curPos <= len(data)", which got us here
+		if curPos == len(data) {
 			fileComplete = true
 			break
 		}
 
 		// Perform our READs until GOOD packet
+		retries := 0
 		for {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 			_, readRemoteAddr, err := conn.ReadFromUDP(ackBuffer)
 
+			// Operator asked us to stop (see Transfer.Abort)
+			if t.Aborted() {
+				doSendError(t, ErrorNotDefined, "Transfer aborted by operator")
+				return
+			}
+
+			// Timeout: the DATA or its ACK went missing, send it again
+			if isTimeout(err) && retries < MaxRetries {
+				retries++
+				t.Retry()
+				metrics.Timeouts.Add(1)
+				metrics.BytesSent.Add(uint64(packetSize))
+				t.Debug("timeout, resending block", "block", curBlock, "retry", retries)
+				conn.WriteToUDP(dataBuffer, remoteAddr)
+				continue
+			}
+			if isTimeout(err) {
+				metrics.Timeouts.Add(1)
+			}
 			if err != nil {
 				errmsg := fmt.Sprintf("ERROR:[%s] doReadReq()::conn.Read()::readRemoteAdrr:[%s]\n", err.Error(), readRemoteAddr)
-				doSendError(conn, ErrorNotDefined, errmsg)
+				doSendError(t, ErrorNotDefined, errmsg)
 				return
 			}
 			if readRemoteAddr.Port != remoteAddr.Port {
 				errmsg := fmt.Sprintf("ERROR: doReadReq()::remoteAddr.Port:[%d] != readRemoteAddr.Port:[%d] ", remoteAddr.Port, readRemoteAddr.Port)
-				doSendError(conn, ErrorUnknownTID, errmsg)
+				// NOTE: this goes to the stranger, not our client (RFC1350: the transfer carries on)
+				t.Error("unknown transfer id", "from", readRemoteAddr.String())
+				p := NewPacketError(ErrorUnknownTID, errmsg)
+				conn.WriteToUDP(p.Serialize(), readRemoteAddr)
 				continue
 			}
 			break
@@ -230,11 +442,14 @@ func doReadReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pac
 		err = ackPacket.Parse(ackBuffer)
 		if err != nil {
 			errmsg := fmt.Sprintf("ERROR:[%s] doReadReq()::AckPacket.Parse()", err.Error())
-			doSendError(conn, ErrorNotDefined, errmsg) // ?? @TODO Is this an OP error?
+			doSendError(t, ErrorNotDefined, errmsg) // ?? @TODO Is this an OP error?
 			return
 		}
 
 		// Set current block to be the ackPacket's blocknum (as it could have incremented this value in resends of Ack)
+		if ackPacket.BlockNum != curBlock {
+			t.Retry()
+		}
 		curBlock = ackPacket.BlockNum + 1
 
 		// Advance our position in the file
@@ -244,45 +459,119 @@ func doReadReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pac
 			break
 		} else {
 			curPos = curPos + packetSize
+			t.SetProgress(ackPacket.BlockNum, curPos)
 		}
 
 	}
 
-	// Useful debugging
-	md5, err := nexus.md5sum(entry)
+	// Checksum for the logs and the audit record
+	sum, err := nexus.sha256sum(entry)
 	if err != nil {
-		logError.Printf("WRITE: Unable to md5sum()::err.Error():[%s]", err.Error())
+		t.Error("unable to sha256sum", "err", err)
 	}
-	logDebug.Printf("DEBUG: READ:%s %s\n", md5, packet.Filename)
 
 	if fileComplete {
-		logInfo.Printf("READ: SUCCESS file:[%s], client:[%s] md5:[%s]\n", packet.Filename, remoteAddr.String(), md5)
+		t.Completed = true
+		t.SHA256 = sum
+		t.Info("success", "sha256", sum)
 	} else {
-		logError.Printf("READ: INCOMPLETE! file:[%s], bytes:[%d], client:[%s] md5:[%s]\n", packet.Filename, len(entry.Bytes), remoteAddr.String(), md5)
+		t.Error("incomplete", "size", len(data), "sha256", sum)
 	}
 }
 
 // doWriteReq will process the incoming request packet and continue until file req processed
-func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, packet PacketRequest) {
+func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, packet PacketRequest, root string, timeout int) {
 
-	logInfo.Printf("WRITE: REQUEST file:[%s], client:[%s]\n", packet.Filename, remoteAddr.String())
+	t := NewTransfer(conn, remoteAddr, DirectionWrite, packet.Filename)
+	defer t.Finish()
+	t.Info("request", "mode", packet.Mode)
 
 	// Validate OpMode
-	if !doValidateOpMode(conn, packet.Mode) {
+	if !doValidateOpMode(t, packet.Mode) {
+		return
+	}
+
+	// Authentication: a request naming a key has to prove it has it, and some servers take no other writes
+	session, err := authKeys.Authenticate(OpWRQ, packet.Filename, packet.Options)
+	if err != nil {
+		doSendError(t, ErrorFileAccessViolation, err.Error())
+		return
+	}
+
+	// Rewrite Rules: the file the requested name maps to
+	if !doRewrite(t, &packet, root) {
+		return
+	}
+	if err := authKeys.Authorize(session, OpWRQ, t.Name); err != nil {
+		doSendError(t, ErrorFileAccessViolation, err.Error())
 		return
 	}
 
-	// Load the File into Nexus
-	entry, err := nexus.GetEntry(conn, remoteAddr.String(), packet.Filename)
+	// Write Policy: where the upload is saved, if at all
+	target, err := writePolicies.Reserve(packet.Filename)
 	if err != nil {
-		logError.Printf("doWriteReq()::GetEntry()::remoteAddr.String():[%s]::packet.Filename:[%s] err.Error():[%s]", remoteAddr.String(), packet.Filename, err.Error())
+		doSendError(t, ErrorFileExists, err.Error())
 		return
 	}
+	defer writePolicies.Release(target)
+	if target != filepath.Clean(packet.Filename) {
+		t.Info("saving as", "target", target)
+		t.Path = target
+	}
+
+	// Quotas: is there room for (at least the start of) the file?
+	upload, err := quotas.Begin(remoteAddr.IP, target)
+	if err != nil {
+		doSendError(t, ErrorDiskFull, err.Error())
+		return
+	}
+	defer func() {
+		upload.End(t.Completed)
+
+		// A failed upload leaves partial (or zeroed) data in the nexus, drop it so the file is re-read from disk
+		if !t.Completed {
+			nexus.Discard(remoteAddr.String(), target)
+		}
+	}()
+
+	// Load the File into Nexus, or (for a backend that takes uploads) send it there as it arrives; the
+	// cached copy is dropped, and fetched again once the upload is committed
+	var entry *FileEntry
+	var sink BackendUpload
+	if uploader, ok := vroots.Backend(root).(Uploader); ok {
+		nexus.Discard(remoteAddr.String(), target)
+		sink, err = uploader.Upload(context.Background(), backendName(root, target))
+		if err != nil {
+			doSendError(t, ErrorNotDefined, err.Error())
+			return
+		}
+		defer func() {
+			if !t.Completed {
+				if err := sink.Abort(); err != nil {
+					t.Error("unable to abort backend upload", "err", err)
+				}
+			}
+		}()
+		entry = NewFileEntry()
+	} else {
+		entry, err = nexus.GetEntry(remoteAddr.String(), target)
+		if err != nil {
+			doSendError(t, ErrorFileNotFound, err.Error())
+			return
+		}
+	}
 
-	// Zero out the file
+	// Zero out the file (it may be sharing its bytes with an identical file, see FileNexus.dedupe)
 	if len(entry.Bytes) > 0 {
 		entry.Bytes = nil
 	}
+	entry.digest = ""
+	t.Accept()
+
+	// The client's tsize (RFC2349), if it sent one, is the size its progress is shown against
+	if size, err := strconv.Atoi(packet.Options["tsize"]); err == nil && size > 0 {
+		t.SetSize(size)
+	}
 
 	// Create ACK Packet (Reusable)
 	ackPacket := PacketAck{}
@@ -299,13 +588,10 @@ func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pa
 
 	for {
 
-		// Send the ACK Packet
-		ackPacket.BlockNum = curBlock
-		_, err := conn.WriteToUDP(ackPacket.Serialize(), remoteAddr)
-		if err != nil {
-			errmsg := fmt.Sprintf("ERROR:[%s] doWriteReq()::conn.WriteToUDP()::remoteAddr:[%s]", err.Error(), remoteAddr.String())
-			doSendError(conn, ErrorNotDefined, errmsg)
-			return
+		// Pace the ACK for the block we just received, under the global/client/file rate limits (the client
+		// won't send the next block until it has it)
+		if curBlock > 0 {
+			rateLimiter.Wait(remoteAddr, t.Name, cntReadActual-4)
 		}
 
 		/*
@@ -314,27 +600,65 @@ func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pa
 			if this condition happens, then the last packet was received, since it
 			was less than 512b payload + 4b header.. or a zero-byte packet which
 			contains only the 4-bytes for Op/Mode
+			NOTE: the last ACK is only sent once the file is saved, see below
 		*/
 		if cntReadActual < MaxDataBlockSize+4 {
 			fileComplete = true
 			break
 		}
 
+		// Send the ACK Packet (an authenticated WRQ gets an OACK instead of ACK 0)
+		ackPacket.BlockNum = curBlock
+		ackBuffer := ackPacket.Serialize()
+		if curBlock == 0 && session != nil {
+			oackPacket := PacketOAck{Options: session.oack(nil, "")}
+			ackBuffer = oackPacket.Serialize()
+		}
+		_, err := conn.WriteToUDP(ackBuffer, remoteAddr)
+		if err != nil {
+			errmsg := fmt.Sprintf("ERROR:[%s] doWriteReq()::conn.WriteToUDP()::remoteAddr:[%s]", err.Error(), remoteAddr.String())
+			doSendError(t, ErrorNotDefined, errmsg)
+			return
+		}
+
 		// Perform our READs until GOOD packet
 		var cntReadFromUDP int = 0
 		var clientAddr *net.UDPAddr
 		rcvBuf := make([]byte, MaxPacketSize) // Data comes in as 2048 packets .. moved down here, as it was getting weird concurrency issues
+		retries := 0
 		for {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 			cntReadFromUDP, clientAddr, err = conn.ReadFromUDP(rcvBuf)
 
+			// Operator asked us to stop (see Transfer.Abort)
+			if t.Aborted() {
+				doSendError(t, ErrorNotDefined, "Transfer aborted by operator")
+				return
+			}
+
+			// Timeout: the ACK or the next DATA went missing, ACK again
+			if isTimeout(err) && retries < MaxRetries {
+				retries++
+				t.Retry()
+				metrics.Timeouts.Add(1)
+				t.Debug("timeout, resending ack", "block", curBlock, "retry", retries)
+				conn.WriteToUDP(ackBuffer, remoteAddr)
+				continue
+			}
+			if isTimeout(err) {
+				metrics.Timeouts.Add(1)
+			}
 			if err != nil {
 				errmsg := fmt.Sprintf("ERROR: doWriteReq()::conn.ReadFromUDP()::remoteAddr:[%s]::err.Error():[%s]\n", remoteAddr, err.Error())
-				doSendError(conn, ErrorNotDefined, errmsg)
+				doSendError(t, ErrorNotDefined, errmsg)
 				return
 			}
 			if clientAddr.Port != remoteAddr.Port {
 				errmsg := fmt.Sprintf("ERROR: doWriteReq()::clientAddr.Port!=remoteAddr.Port::clientAddr.Port:[%d]::remoteAddr.Port:[%d]\n", clientAddr.Port, remoteAddr.Port)
-				doSendError(conn, ErrorUnknownTID, errmsg)
+				// NOTE: this goes to the stranger, not our client (RFC1350: the transfer carries on)
+				t.Error("unknown transfer id", "from", clientAddr.String())
+				p := NewPacketError(ErrorUnknownTID, errmsg)
+				conn.WriteToUDP(p.Serialize(), clientAddr)
 				continue
 			}
 			break
@@ -344,14 +668,15 @@ func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pa
 		err = packetData.Parse(rcvBuf)
 		if err != nil {
 			errmsg := fmt.Sprintf("ERROR: doWriteReq()::PacketData.Parse()::err.Error():[%s]", err.Error())
-			doSendError(conn, ErrorIllegalOp, errmsg)
+			doSendError(t, ErrorIllegalOp, errmsg)
 			return
 		}
 
-		// fmt.Fprintf(os.Stdout, "DEBUG::WRITE: STATUS curBlock:[%d] len(entry.Bytes):[%d] cntReadFromUDP:[%d]\n", curBlock, len(entry.Bytes), cntReadFromUDP)
+		t.Debug("received block", "block", packetData.BlockNum, "size", cntReadFromUDP-4)
 
 		// Out of order, as this isn't the next seq block req. As a result, we will loop and re-ack what we want
 		if packetData.BlockNum-1 != curBlock {
+			t.Retry()
 			continue
 		}
 
@@ -359,9 +684,24 @@ func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pa
 		// @TODO optimize: make Nexus func to perform this work, but alloc an ever increasing size and maintain a
 		// 		length variable of data used in alloc (this will prevent the thrashing of memory to constantly move
 		//      this array around to seq memory)
+		// Quotas: refuse the block (and the rest of the file) as soon as a limit is hit
+		if err := upload.Grow(cntReadFromUDP - 4); err != nil {
+			doSendError(t, ErrorDiskFull, err.Error())
+			return
+		}
+
 		if cntReadFromUDP > 4 {
 			entry.Bytes = append(entry.Bytes, packetData.Data[:cntReadFromUDP-4]...) // NOTE: Slice is used: 4 bytes for OP&BlockNum, then the rest of the data
+			metrics.BytesReceived.Add(uint64(cntReadFromUDP - 4))
+
+			if sink != nil {
+				if _, err := sink.Write(packetData.Data[:cntReadFromUDP-4]); err != nil {
+					doSendError(t, ErrorNotDefined, err.Error())
+					return
+				}
+			}
 		}
+		t.SetProgress(packetData.BlockNum, len(entry.Bytes))
 		cntReadActual = cntReadFromUDP
 		curBlock = curBlock + 1
 
@@ -370,21 +710,47 @@ func doWriteReq(nexus *FileNexus, conn *net.UDPConn, remoteAddr *net.UDPAddr, pa
 	// COMPLETE: Output and Save File
 	if fileComplete {
 
-		// Useful debugging
-		md5, err := nexus.md5sum(entry)
+		// Checksum for the logs and the audit record
+		sum, err := nexus.sha256sum(entry)
 		if err != nil {
-			logError.Printf("WRITE: Unable to md5sum()::err.Error():[%s]", err.Error())
+			t.Error("unable to sha256sum", "err", err)
+		}
+		t.SHA256 = sum
+
+		// Authentication: the file has to be the one the key signed for
+		if session != nil && sum != session.sha256 {
+			doSendError(t, ErrorFileAccessViolation, fmt.Sprintf("ERROR: sha256:[%s] isn't auth-sha256:[%s]", sum, session.sha256))
+			return
 		}
-		logDebug.Printf("DEBUG: READ:%s %s\n", md5, packet.Filename)
 
-		logInfo.Printf("WRITE: SUCCESS file:[%s], bytes:[%d], client:[%s] md5:[%s]\n", packet.Filename, len(entry.Bytes), remoteAddr.String(), md5)
-		err = nexus.saveBytes(remoteAddr.String(), packet.Filename)
+		t.Info("success", "sha256", sum)
+		if sink != nil {
+			err = sink.Commit()
+		} else {
+			err = nexus.saveBytes(remoteAddr.String(), target)
+		}
 		if err != nil {
-			logInfo.Printf("WRITE: ERROR unable to save file:[%s]", packet.Filename)
+			doSendError(t, ErrorNotDefined, fmt.Sprintf("Unable to save file: %s", err.Error()))
+			return
 		}
 
+		// Checksum Sidecars: checked before the last ACK, so the client hears of a mismatch; they are on the
+		// local disk, uploads to a backend aren't checked
+		if sink == nil {
+			if err := verifyUpload(nexus, t, target); err != nil {
+				t.Quarantined = true
+				doSendError(t, ErrorNotDefined, fmt.Sprintf("Upload failed checksum verification, quarantined: %s", err.Error()))
+				return
+			}
+		}
+
+		// The last ACK tells the client the file is saved (or committed to the backend)
+		ackPacket.BlockNum = curBlock
+		conn.WriteToUDP(ackPacket.Serialize(), remoteAddr)
+		t.Completed = true
+
 	} else {
-		logError.Printf("WRITE: INCOMPLETE! file:[%s], bytes:[%d], client:[%s]\n", packet.Filename, len(entry.Bytes), remoteAddr.String())
+		t.Error("incomplete")
 	}
 
 	// @TODO Nullify entry
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarHashes are the checksum sidecars understood, by suffix: "image.bin.sha256" holds the sha256 of "image.bin"
+var sidecarHashes = map[string]func() hash.Hash{
+	".md5":    md5.New,
+	".sha256": sha256.New,
+}
+
+// sidecars is set once at startup, before Serve
+var sidecars = SidecarConfig{}
+
+// SidecarConfig turns on generated sidecars for RRQ, and verification of uploads against their sidecars
+type SidecarConfig struct {
+	Serve      bool   // generate "file.md5"/"file.sha256" for any file without one on disk
+	Quarantine string // verify uploads, moving files that fail here ("" to not verify)
+}
+
+// splitSidecar returns the file a sidecar name is the checksum of, and its hash
+func splitSidecar(filename string) (string, func() hash.Hash, bool) {
+	ext := filepath.Ext(filename)
+	newHash, ok := sidecarHashes[ext]
+	if !ok || len(filename) == len(ext) {
+		return "", nil, false
+	}
+	return strings.TrimSuffix(filename, ext), newHash, true
+}
+
+// sidecarEntry generates the sidecar filename names, in the format of sha256sum/md5sum, when it isn't on disk
+func sidecarEntry(nexus *FileNexus, remoteAddr string, filename string) (*FileEntry, bool) {
+
+	if !sidecars.Serve || fileExists(filename) {
+		return nil, false
+	}
+	base, newHash, ok := splitSidecar(filename)
+	if !ok || !fileExists(base) {
+		return nil, false
+	}
+
+	entry, err := nexus.GetEntry(remoteAddr, base)
+	if err != nil || entry.Bytes == nil {
+		return nil, false
+	}
+	sum, err := nexus.hashsum(entry, newHash())
+	if err != nil {
+		return nil, false
+	}
+
+	sidecar := NewFileEntry()
+	sidecar.Bytes = []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(base)))
+	return sidecar, true
+}
+
+// verifyUpload checks a saved upload against its sidecars, an uploaded sidecar checks the file it's for;
+// on a mismatch the file and its sidecars are moved to quarantine, and dropped from the nexus
+func verifyUpload(nexus *FileNexus, t *Transfer, target string) error {
+
+	if sidecars.Quarantine == "" {
+		return nil
+	}
+
+	file := target
+	if base, _, ok := splitSidecar(target); ok {
+		file = base
+	}
+	if !fileExists(file) {
+		return nil // the file is still to come, it's checked once it arrives
+	}
+
+	var mismatch error
+	var found []string
+	for ext, newHash := range sidecarHashes {
+		sidecar := file + ext
+		if !fileExists(sidecar) {
+			continue
+		}
+		found = append(found, sidecar)
+		if mismatch == nil {
+			mismatch = checkSidecar(file, sidecar, newHash())
+		}
+	}
+	if mismatch == nil {
+		if len(found) > 0 {
+			t.Info("checksum verified", "file", file)
+		}
+		return nil
+	}
+
+	for _, path := range append([]string{file}, found...) {
+		moved, err := quarantine(path)
+		if err != nil {
+			return fmt.Errorf("%s, and %s", mismatch.Error(), err.Error())
+		}
+		nexus.Discard(t.Client.String(), path)
+		t.Error("quarantined", "file", path, "to", moved)
+	}
+
+	return mismatch
+}
+
+// checkSidecar compares the checksum in sidecar (the first word, as written by sha256sum) with file's
+func checkSidecar(file string, sidecar string, hasher hash.Hash) error {
+
+	content, err := os.ReadFile(sidecar)
+	if err != nil {
+		return fmt.Errorf("checkSidecar(): sidecar:[%s] err.Error():[%s]", sidecar, err.Error())
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("checkSidecar(): empty sidecar:[%s]", sidecar)
+	}
+	expected := strings.ToLower(fields[0])
+
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("checkSidecar(): file:[%s] err.Error():[%s]", file, err.Error())
+	}
+	defer f.Close()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return fmt.Errorf("checkSidecar(): file:[%s] err.Error():[%s]", file, err.Error())
+	}
+
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch: file:[%s] sidecar:[%s] expected:[%s] actual:[%s]", file, sidecar, expected, actual)
+	}
+
+	return nil
+}
+
+// quarantine moves path into the quarantine directory, without replacing anything already there
+func quarantine(path string) (string, error) {
+
+	moved := filepath.Join(sidecars.Quarantine, filepath.Base(path))
+	if fileExists(moved) {
+		moved = nextVersion(moved, fileExists)
+	}
+
+	if err := os.Rename(path, moved); err != nil {
+		return "", fmt.Errorf("quarantine(): path:[%s] err.Error():[%s]", path, err.Error())
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSidecars(t *testing.T) {
+	dir := t.TempDir()
+	quarantineDir := t.TempDir()
+	data := []byte("a firmware image")
+	sha := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	t.Cleanup(func() { sidecars = SidecarConfig{} })
+	sidecars = SidecarConfig{Serve: true, Quarantine: quarantineDir}
+	server := startServer(t, NewFileNexus())
+
+	// RRQ: generated for a file without one
+	os.WriteFile(filepath.Join(dir, "served.bin"), data, 0644)
+	got, err := tftpGet(server, filepath.Join(dir, "served.bin.sha256"))
+	if expected := sha + "  served.bin\n"; err != nil || string(got) != expected {
+		t.Errorf("generated sidecar: expected %q; got %q, err:%v", expected, got, err)
+	}
+
+	// WRQ: file then a matching sidecar, both stay
+	good := filepath.Join(dir, "good.bin")
+	if err := tftpPut(server, good, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tftpPut(server, good+".sha256", []byte(sha+"  good.bin\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(good) || !fileExists(good+".sha256") {
+		t.Errorf("verified upload: expected %s and its sidecar to stay", good)
+	}
+
+	// WRQ: a sidecar then a file that doesn't match, both are quarantined
+	bad := filepath.Join(dir, "bad.bin")
+	if err := tftpPut(server, bad+".md5", []byte(fmt.Sprintf("%x\n", md5.Sum([]byte("something else"))))); err != nil {
+		t.Fatal(err)
+	}
+	if err := tftpPut(server, bad, data); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("failed upload: expected an ERROR instead of the last ACK; got %v", err)
+	}
+	if fileExists(bad) || fileExists(bad+".md5") {
+		t.Errorf("failed upload: expected %s and its sidecar to be moved", bad)
+	}
+	if moved, _ := os.ReadFile(filepath.Join(quarantineDir, "bad.bin")); string(moved) != string(data) {
+		t.Errorf("failed upload: expected it in quarantine; got %q", moved)
+	}
+	if !fileExists(filepath.Join(quarantineDir, "bad.bin.md5")) {
+		t.Errorf("failed upload: expected its sidecar in quarantine")
+	}
+	if _, err := tftpGet(server, bad); err == nil {
+		t.Errorf("failed upload: still served")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction of a Transfer, from the server's point of view
+const (
+	DirectionRead  = "read"
+	DirectionWrite = "write"
+)
+
+// Outcome of a finished Transfer
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+	OutcomeRejected  = "rejected"
+)
+
+// transferIDs hands out a unique ID per transfer, for correlating log events
+var transferIDs atomic.Uint64
+
+// transfers holds every Transfer in progress, by ID
+var transfers = struct {
+	mu     sync.Mutex
+	active map[uint64]*Transfer
+}{active: make(map[uint64]*Transfer)}
+
+// Transfer is the state of a single RRQ/WRQ, from request to completion
+type Transfer struct {
+	ID        uint64
+	Direction string
+	Client    *net.UDPAddr
+	Filename  string
+	Name      string // the file under the client's root, which rate limits and auth paths are matched against
+	Path      string // the file on disk, an upload may be saved under another name than requested
+	BlockSize int
+	Started   time.Time
+
+	// Progress: written under mu by the transfer's goroutine, see Snapshot for reading from elsewhere
+	mu      sync.Mutex
+	Block   uint16
+	Bytes   int
+	Size    int // total bytes expected, 0 if unknown
+	Retries int
+
+	// Completed is set once the last block has moved, ErrorCode is the last ERROR sent (-1 for none)
+	Completed   bool
+	ErrorCode   int
+	SHA256      string
+	Quarantined bool // the upload failed its checksum sidecar
+
+	accepted bool
+	aborted  atomic.Bool
+	detached atomic.Bool // finished by a multicast session, not by the thread that took the request
+	conn     *net.UDPConn
+	log      *slog.Logger
+}
+
+// TransferSnapshot is a point-in-time copy of a Transfer's progress
+type TransferSnapshot struct {
+	ID        uint64  `json:"id"`
+	Direction string  `json:"direction"`
+	Client    string  `json:"client"`
+	Filename  string  `json:"file"`
+	Block     uint16  `json:"block"`
+	Bytes     int     `json:"bytes"`
+	Size      int     `json:"size,omitempty"`
+	Retries   int     `json:"retries"`
+	Seconds   float64 `json:"seconds"`
+	Rate      float64 `json:"rate"` // bytes/sec
+	Aborted   bool    `json:"aborted,omitempty"`
+}
+
+// NewTransfer creates the struct, with a logger carrying the transfer's context
+func NewTransfer(conn *net.UDPConn, client *net.UDPAddr, direction string, filename string) *Transfer {
+
+	t := &Transfer{
+		ID:        transferIDs.Add(1),
+		Direction: direction,
+		Client:    client,
+		Filename:  filename,
+		Name:      filename,
+		Path:      filename,
+		BlockSize: MaxDataBlockSize,
+		Started:   time.Now(),
+		ErrorCode: -1,
+		conn:      conn,
+	}
+	t.log = logger.With(
+		"transfer", t.ID,
+		"client", client.String(),
+		"file", filename,
+		"direction", direction,
+		"blksize", t.BlockSize,
+	)
+
+	transfers.mu.Lock()
+	transfers.active[t.ID] = t
+	transfers.mu.Unlock()
+	metrics.ActiveTransfers.Add(1)
+	hooks.Fire(EventRequest, t)
+
+	return t
+}
+
+// ActiveTransfers returns a snapshot of every transfer in progress, oldest first
+func ActiveTransfers() []TransferSnapshot {
+
+	transfers.mu.Lock()
+	list := make([]*Transfer, 0, len(transfers.active))
+	for _, t := range transfers.active {
+		list = append(list, t)
+	}
+	transfers.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	result := make([]TransferSnapshot, len(list))
+	for i, t := range list {
+		result[i] = t.Snapshot()
+	}
+	return result
+}
+
+// FindTransfer returns the transfer in progress with the ID, or nil
+func FindTransfer(id uint64) *Transfer {
+	transfers.mu.Lock()
+	defer transfers.mu.Unlock()
+	return transfers.active[id]
+}
+
+// SetProgress records the current block and bytes moved
+func (t *Transfer) SetProgress(block uint16, bytes int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Block = block
+	t.Bytes = bytes
+}
+
+// SetSize records the total bytes the transfer is expected to move
+func (t *Transfer) SetSize(size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Size = size
+}
+
+// Retry counts a DATA/ACK sent again
+func (t *Transfer) Retry() {
+	t.mu.Lock()
+	t.Retries++
+	t.mu.Unlock()
+	metrics.Retransmissions.Add(1)
+}
+
+// Snapshot copies the transfer's progress, safe to call from any goroutine
+func (t *Transfer) Snapshot() TransferSnapshot {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seconds := time.Since(t.Started).Seconds()
+	snap := TransferSnapshot{
+		ID:        t.ID,
+		Direction: t.Direction,
+		Client:    t.Client.String(),
+		Filename:  t.Filename,
+		Block:     t.Block,
+		Bytes:     t.Bytes,
+		Size:      t.Size,
+		Retries:   t.Retries,
+		Seconds:   seconds,
+		Aborted:   t.aborted.Load(),
+	}
+	if seconds > 0 {
+		snap.Rate = float64(t.Bytes) / seconds
+	}
+	return snap
+}
+
+// Abort asks the transfer to stop, it sends ERROR to the client and gives up at its next read
+func (t *Transfer) Abort() {
+	t.aborted.Store(true)
+	if t.conn != nil {
+		// Wake up a blocked read, the transfer checks Aborted() before retrying
+		t.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Aborted determines if an operator asked for the transfer to stop
+func (t *Transfer) Aborted() bool {
+	return t.aborted.Load()
+}
+
+// Accept marks the request as accepted, data is about to move, a failure after this is no longer a rejection
+func (t *Transfer) Accept() {
+	t.accepted = true
+}
+
+// Outcome of the transfer: completed, failed (after it was accepted) or rejected (before)
+func (t *Transfer) Outcome() string {
+	switch {
+	case t.Completed:
+		return OutcomeCompleted
+	case t.accepted:
+		return OutcomeFailed
+	default:
+		return OutcomeRejected
+	}
+}
+
+// Finish accounts for the transfer once it is over, whatever the outcome; a detached transfer is left to its
+// multicast session (see multicast.go)
+func (t *Transfer) Finish() {
+	if !t.detached.Load() {
+		t.finish()
+	}
+}
+
+func (t *Transfer) finish() {
+
+	op := "rrq"
+	if t.Direction == DirectionWrite {
+		op = "wrq"
+	}
+
+	transfers.mu.Lock()
+	delete(transfers.active, t.ID)
+	transfers.mu.Unlock()
+
+	metrics.ActiveTransfers.Add(-1)
+	metrics.TransferDone(op, t.Outcome(), time.Since(t.Started).Seconds())
+	audit.Record(t)
+
+	if t.Completed {
+		hooks.Fire(EventCompleted, t)
+	} else {
+		hooks.Fire(EventFailed, t)
+	}
+}
+
+// Debug logs a debug event for the transfer
+func (t *Transfer) Debug(msg string, args ...any) {
+	t.event(slog.LevelDebug, msg, args...)
+}
+
+// Info logs an info event for the transfer
+func (t *Transfer) Info(msg string, args ...any) {
+	t.event(slog.LevelInfo, msg, args...)
+}
+
+// Error logs an error event for the transfer
+func (t *Transfer) Error(msg string, args ...any) {
+	t.event(slog.LevelError, msg, args...)
+}
+
+// event logs msg, adding the bytes moved and time taken so far
+func (t *Transfer) event(level slog.Level, msg string, args ...any) {
+	args = append(args, "bytes", t.Bytes, "duration", time.Since(t.Started))
+	t.log.Log(context.Background(), level, msg, args...)
+}
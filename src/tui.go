@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardLogLines is how many recent log lines the dashboard keeps
+const dashboardLogLines = 8
+
+// Dashboard is the --tui live view of active transfers. It is also the log writer while it runs,
+// keeping the last few lines to show below the transfers rather than letting them scroll.
+type Dashboard struct {
+	out     io.Writer
+	started time.Time
+
+	mu      sync.Mutex
+	partial []byte
+	recent  []string
+}
+
+// NewDashboard creates the struct, rendering to out
+func NewDashboard(out io.Writer) *Dashboard {
+	return &Dashboard{out: out, started: time.Now()}
+}
+
+// isTerminal determines if f is a TTY (a character device), rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write keeps complete log lines for display, so the dashboard can be the logger's io.Writer
+func (d *Dashboard) Write(p []byte) (int, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		d.recent = append(d.recent, string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+	if len(d.recent) > dashboardLogLines {
+		d.recent = d.recent[len(d.recent)-dashboardLogLines:]
+	}
+
+	return len(p), nil
+}
+
+// Run redraws the dashboard every interval, forever
+func (d *Dashboard) Run(interval time.Duration) {
+	for {
+		d.Render()
+		time.Sleep(interval)
+	}
+}
+
+// Render draws one frame: summary totals, a row per active transfer and the recent log
+func (d *Dashboard) Render() {
+
+	var b strings.Builder
+
+	// Home the cursor and clear, so each frame replaces the last
+	b.WriteString("\x1b[H\x1b[2J")
+
+	active := ActiveTransfers()
+	completed, failed, rejected := metrics.Outcomes()
+	state := ""
+	if Paused() {
+		state = "  [PAUSED]"
+	}
+	fmt.Fprintf(&b, "TFTP Server  up %s  active %d  completed %d  failed %d  rejected %d%s\n",
+		time.Since(d.started).Round(time.Second), len(active), completed, failed, rejected, state)
+	fmt.Fprintf(&b, "sent %s  received %s  retransmissions %d  timeouts %d\n\n",
+		humanBytes(float64(metrics.BytesSent.Load())), humanBytes(float64(metrics.BytesReceived.Load())),
+		metrics.Retransmissions.Load(), metrics.Timeouts.Load())
+
+	fmt.Fprintf(&b, "%-6s %-5s %-22s %-28s %-18s %-11s %s\n", "ID", "DIR", "CLIENT", "FILE", "PROGRESS", "RATE", "RETRIES")
+	for _, t := range active {
+		fmt.Fprintf(&b, "%-6d %-5s %-22s %-28s %-18s %-11s %d\n",
+			t.ID, t.Direction, truncate(t.Client, 22), truncate(t.Filename, 28), progress(t), humanBytes(t.Rate)+"/s", t.Retries)
+	}
+	if len(active) == 0 {
+		b.WriteString("(no active transfers)\n")
+	}
+
+	b.WriteString("\nRecent log\n")
+	d.mu.Lock()
+	for _, line := range d.recent {
+		b.WriteString(truncate(line, 160))
+		b.WriteString("\n")
+	}
+	d.mu.Unlock()
+
+	io.WriteString(d.out, b.String())
+}
+
+// progress is a bar and percentage when the size is known, bytes moved otherwise
+func progress(t TransferSnapshot) string {
+	if t.Size <= 0 {
+		return humanBytes(float64(t.Bytes))
+	}
+	// More bytes than expected (a wrong Content-Length, a resent block) shows as full, not as a broken bar
+	pct := min(max(t.Bytes*100/t.Size, 0), 100)
+	filled := pct / 10
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat(" ", 10-filled), pct)
+}
+
+// humanBytes formats n as B, KB, MB, GB (1024 based)
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// truncate shortens s to width, keeping the end (the interesting part of a path)
+func truncate(s string, width int) string {
+	if len(s) <= width {
+		return s
+	}
+	return "..." + s[len(s)-width+3:]
+}
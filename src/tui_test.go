@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		bytes, size int
+		expected    string
+	}{
+		{0, 0, "0 B"},
+		{512, 1024, "[#####     ]  50%"},
+		{1536, 1024, "[##########] 100%"}, // more than expected, e.g. a wrong Content-Length
+	}
+	for _, test := range tests {
+		if bar := progress(TransferSnapshot{Bytes: test.bytes, Size: test.size}); bar != test.expected {
+			t.Errorf("%d of %d: expected %q; got %q", test.bytes, test.size, test.expected, bar)
+		}
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	dir := t.TempDir()
+	size := 64 * 1024
+
+	// Slowed down so the upload can be seen in progress, with the size its tsize gave
+	t.Cleanup(func() { rateLimiter.SetLimits(RateLimits{}) })
+	rateLimiter.SetLimits(RateLimits{Global: 64 * 1024})
+	server := startServer(t, NewFileNexus())
+
+	done := make(chan error)
+	go func() {
+		_, err := tftpPutOptions(server, filepath.Join(dir, "upload.bin"), make([]byte, size), map[string]string{"tsize": "65536"})
+		done <- err
+	}()
+
+	seen := 0
+	for deadline := time.Now().Add(5 * time.Second); seen == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, tr := range ActiveTransfers() {
+			if strings.HasSuffix(tr.Filename, "upload.bin") && tr.Bytes > 0 {
+				seen = tr.Size
+			}
+		}
+	}
+	if seen != size {
+		t.Errorf("expected the upload's size %d from tsize; got %d", size, seen)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
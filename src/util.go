@@ -1,6 +1,14 @@
 package main
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
 
 // fileExists determines if the fileexists and it's *NOT* a directory
 func fileExists(filename string) bool {
@@ -10,3 +18,53 @@ func fileExists(filename string) bool {
 	}
 	return !info.IsDir()
 }
+
+// isTimeout determines if err is a read/write deadline expiring
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ParseByteSize parses a byte count with an optional k/M/G suffix (1024 based), such as "512k" or "10M"
+func ParseByteSize(s string) (int64, error) {
+
+	multiplier := int64(1)
+	num := strings.TrimSpace(s)
+	if num != "" {
+		switch strings.ToUpper(num[len(num)-1:]) {
+		case "K":
+			multiplier = 1024
+		case "M":
+			multiplier = 1024 * 1024
+		case "G":
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("ParseByteSize(): invalid size:[%s]", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// isNotExist determines if err (or what it wraps) is a missing file
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// routeSource is the local (IPv4) address packets to dst leave from, nil if there is no route: a connected UDP
+// socket sends nothing, but has its local address picked by a route lookup
+func routeSource(dst *net.UDPAddr) net.IP {
+
+	probe, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return nil
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).IP.To4()
+}
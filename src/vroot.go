@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// vroots picks each client's root directory, nil when files are served from the working directory (or chroot)
+var vroots *VirtualRoots
+
+// VirtualRoot is a root directory for clients in a subnet, or for requests sent to a local address
+type VirtualRoot struct {
+	Subnet *net.IPNet // client subnet, nil for a local address or the default
+	Local  net.IP     // local (listening) address, nil for a client subnet or the default
+	Dir    string
+}
+
+// VirtualRoots resolves a request's root: the narrowest client subnet, then the local address, then the default
+type VirtualRoots struct {
+	roots    []VirtualRoot
+	fallback string             // "" refuses requests that match no root
+	backends map[string]Backend // by root directory, for the roots with a backend of their own
+}
+
+// NewVirtualRoots creates the struct, a root with neither Subnet nor Local is the default
+func NewVirtualRoots(roots []VirtualRoot) *VirtualRoots {
+
+	v := &VirtualRoots{backends: make(map[string]Backend)}
+	for _, root := range roots {
+		if root.Subnet == nil && root.Local == nil {
+			v.fallback = root.Dir
+			continue
+		}
+		v.roots = append(v.roots, root)
+	}
+
+	return v
+}
+
+// Resolve returns the root directory for a request from client to local, false if there is none
+func (v *VirtualRoots) Resolve(client net.IP, local net.IP) (string, bool) {
+
+	if v == nil {
+		return "", true
+	}
+
+	// Client subnets: the longest prefix wins
+	dir, bits := "", -1
+	for _, root := range v.roots {
+		if root.Subnet == nil || !root.Subnet.Contains(client) {
+			continue
+		}
+		if ones, _ := root.Subnet.Mask.Size(); ones > bits {
+			dir, bits = root.Dir, ones
+		}
+	}
+	if bits >= 0 {
+		return dir, true
+	}
+
+	// Local address: which of the server's addresses (VLANs) the request came in on
+	for _, root := range v.roots {
+		if root.Local != nil && root.Local.Equal(local) {
+			return root.Dir, true
+		}
+	}
+
+	return v.fallback, v.fallback != ""
+}
+
+// SetBackends gives roots a backend of their own, from "dir=backend" pairs as given to --root-backend; dir is
+// one of the roots' directories
+func (v *VirtualRoots) SetBackends(specs []string) error {
+
+	for _, spec := range specs {
+		dir, target, ok := strings.Cut(spec, "=")
+		if !ok || target == "" {
+			return fmt.Errorf("SetBackends(): expected dir=backend, got:[%s]", spec)
+		}
+		if !v.has(dir) {
+			return fmt.Errorf("SetBackends(): dir:[%s] is not a --root", dir)
+		}
+		b, err := NewBackend(target)
+		if err != nil {
+			return err
+		}
+		v.backends[dir] = b
+	}
+
+	return nil
+}
+
+// has reports whether dir is one of the roots
+func (v *VirtualRoots) has(dir string) bool {
+
+	if v == nil {
+		return false
+	}
+	if v.fallback == dir {
+		return true
+	}
+	for _, root := range v.roots {
+		if root.Dir == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Backend returns the backend for files under root: its own, or else --backend (nil for none)
+func (v *VirtualRoots) Backend(root string) Backend {
+	if v != nil {
+		if b, ok := v.backends[root]; ok {
+			return b
+		}
+	}
+	return backend
+}
+
+// TakesUploads reports whether uploads may go to a backend (--backend, or a root's own) instead of the local disk
+func (v *VirtualRoots) TakesUploads() bool {
+	if _, ok := backend.(Uploader); ok {
+		return true
+	}
+	if v != nil {
+		for _, b := range v.backends {
+			if _, ok := b.(Uploader); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// underRoot maps a requested filename into root, ".." can't climb out of it
+func underRoot(root string, filename string) string {
+	if root == "" {
+		return filename
+	}
+	return filepath.Join(root, filepath.Clean("/"+filename))
+}
+
+// ParseVirtualRoots parses "cidr=dir", "@local-ip=dir" and "*=dir" (the default) pairs, as given to --root
+func ParseVirtualRoots(specs []string) ([]VirtualRoot, error) {
+
+	var result []VirtualRoot
+	for _, spec := range specs {
+		key, dir, ok := strings.Cut(spec, "=")
+		if !ok || dir == "" {
+			return nil, fmt.Errorf("ParseVirtualRoots(): expected cidr=dir, @ip=dir or *=dir, got:[%s]", spec)
+		}
+
+		root := VirtualRoot{Dir: dir}
+		switch {
+		case key == "*":
+		case strings.HasPrefix(key, "@"):
+			root.Local = net.ParseIP(key[1:])
+			if root.Local == nil {
+				return nil, fmt.Errorf("ParseVirtualRoots(): invalid local address:[%s]", key[1:])
+			}
+		default:
+			_, subnet, err := net.ParseCIDR(key)
+			if err != nil {
+				return nil, fmt.Errorf("ParseVirtualRoots(): err.Error():[%s]", err.Error())
+			}
+			root.Subnet = subnet
+		}
+		result = append(result, root)
+	}
+
+	return result, nil
+}
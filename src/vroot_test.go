@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestVirtualRootsResolve(t *testing.T) {
+	roots, err := ParseVirtualRoots([]string{
+		"10.0.0.0/8=/srv/tftp/lab",
+		"10.1.0.0/16=/srv/tftp/lab-b",
+		"@192.168.0.1=/srv/tftp/office",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVirtualRoots(roots)
+
+	tests := []struct {
+		client, local string
+		expected      string
+		ok            bool
+	}{
+		{"10.2.0.5", "192.168.0.1", "/srv/tftp/lab", true},
+		{"10.1.0.5", "192.168.0.1", "/srv/tftp/lab-b", true},
+		{"172.16.0.5", "192.168.0.1", "/srv/tftp/office", true},
+		{"172.16.0.5", "172.16.0.1", "", false},
+	}
+	for _, test := range tests {
+		dir, ok := v.Resolve(net.ParseIP(test.client), net.ParseIP(test.local))
+		if dir != test.expected || ok != test.ok {
+			t.Errorf("%s to %s: expected %q,%t; got %q,%t", test.client, test.local, test.expected, test.ok, dir, ok)
+		}
+	}
+
+	// With a default, nobody is refused
+	v = NewVirtualRoots(append(roots, VirtualRoot{Dir: "/srv/tftp"}))
+	if dir, ok := v.Resolve(net.ParseIP("172.16.0.5"), nil); dir != "/srv/tftp" || !ok {
+		t.Errorf("default: expected /srv/tftp; got %q,%t", dir, ok)
+	}
+
+	if underRoot("/srv/tftp/lab", "../../etc/passwd") != "/srv/tftp/lab/etc/passwd" {
+		t.Errorf("underRoot: climbed out of the root")
+	}
+	for _, bad := range []string{"10.0.0.0/8", "10.0.0.0/33=/x", "@nowhere=/x"} {
+		if _, err := ParseVirtualRoots([]string{bad}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestVirtualRootsServed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs 127.0.0.2, only Linux routes all of 127.0.0.0/8 to lo")
+	}
+
+	// The same name in two boot trees, the cache mustn't mix them up
+	one, two := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(one, "pxelinux.0"), []byte("lab one"), 0644)
+	os.WriteFile(filepath.Join(two, "pxelinux.0"), []byte("lab two"), 0644)
+
+	t.Cleanup(func() { vroots = nil })
+	vroots = NewVirtualRoots([]VirtualRoot{
+		{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, Dir: one},
+		{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(32, 32)}, Dir: two},
+	})
+	server := startServer(t, NewFileNexus())
+
+	for i := 0; i < 2; i++ {
+		for client, expected := range map[string]string{"127.0.0.1": "lab one", "127.0.0.2": "lab two"} {
+			data, err := tftpGetFrom(net.ParseIP(client), server, "/pxelinux.0")
+			if err != nil || string(data) != expected {
+				t.Errorf("from %s: expected %q; got %q, err:%v", client, expected, data, err)
+			}
+		}
+	}
+
+	if _, err := tftpGetFrom(net.IPv4(127, 0, 0, 3), server, "/pxelinux.0"); err == nil {
+		t.Errorf("from 127.0.0.3: expected refused, no root")
+	}
+}
+
+func TestVirtualRootsBackends(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lab/images/boot.img" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("from the lab's backend"))
+	}))
+	defer origin.Close()
+
+	lab, office := t.TempDir(), t.TempDir()
+	t.Cleanup(func() { vroots = nil })
+	vroots = NewVirtualRoots([]VirtualRoot{
+		{Subnet: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, Dir: lab},
+		{Dir: office},
+	})
+	for _, bad := range []string{lab, "/not/a/root=" + origin.URL, lab + "=ftp://nowhere"} {
+		if err := vroots.SetBackends([]string{bad}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+	if err := vroots.SetBackends([]string{lab + "=" + origin.URL + "/lab"}); err != nil {
+		t.Fatal(err)
+	}
+	if vroots.Backend(lab) == nil || vroots.Backend(office) != nil {
+		t.Fatalf("expected a backend for %s only", lab)
+	}
+	if vroots.TakesUploads() {
+		t.Errorf("expected an http backend not to take uploads")
+	}
+
+	// Missing locally, the file comes from the root's own backend, by its path under the root
+	server := startServer(t, NewFileNexus())
+	if data, err := tftpGet(server, "/images/boot.img"); err != nil || string(data) != "from the lab's backend" {
+		t.Errorf("expected the file from the lab's backend; got %q, err:%v", data, err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // MaxDataBlockSize is set to 512 bytes (per spec)
@@ -20,6 +22,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOAck         = 6 // RFC2347, only ever sent by the server
 )
 
 // Packet is the interface met by all packet structs
@@ -35,6 +38,7 @@ type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	Options  map[string]string // RFC2347, names lower-cased; nil when there are none
 }
 
 // Parse @TODO write up desc
@@ -48,6 +52,9 @@ func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
+	// RFC2347: options the server can't use are ignored, so a malformed (or unterminated) one is dropped along with
+	// anything after it, the request is served with the options before it
+	p.Options, _ = parseOptions(buf)
 	return nil
 }
 
@@ -57,7 +64,26 @@ func (p *PacketRequest) Serialize() []byte {
 	binary.BigEndian.PutUint16(buf, p.Op)
 	copy(buf[2:], p.Filename)
 	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return appendOptions(buf, p.Options)
+}
+
+// PacketOAck acknowledges the options of a request the server has taken up (RFC2347)
+type PacketOAck struct {
+	Options map[string]string
+}
+
+// Parse parses an OACK, as a client would
+func (p *PacketOAck) Parse(buf []byte) (err error) {
+	buf = buf[2:] // skip over op
+	p.Options, err = parseOptions(buf)
+	return err
+}
+
+// Serialize writes the options in name order
+func (p *PacketOAck) Serialize() []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, OpOAck)
+	return appendOptions(buf, p.Options)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -153,6 +179,42 @@ func parseString(buf []byte) (string, []byte, error) {
 	return string(buf[:i]), buf[i+1:], nil
 }
 
+// parseOptions reads the null-terminated name/value pairs after a request's mode (or an OACK's opcode),
+// nil when there are none; on an error it also returns the options read before it
+func parseOptions(buf []byte) (map[string]string, error) {
+	var options map[string]string
+	for len(buf) > 0 {
+		name, rest, err := parseString(buf)
+		if err != nil {
+			return options, err
+		}
+		value, rest, err := parseString(rest)
+		if err != nil {
+			return options, err
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[strings.ToLower(name)] = value
+		buf = rest
+	}
+	return options, nil
+}
+
+// appendOptions writes options as null-terminated name/value pairs, in name order
+func appendOptions(buf []byte, options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = append(append(buf, name...), 0)
+		buf = append(append(buf, options[name]...), 0)
+	}
+	return buf
+}
+
 // ParsePacket parses a packet from its wire representation.
 func ParsePacket(buf []byte) (opcode uint16, p Packet, err error) {
 	if opcode, _, err = parseUint16(buf); err != nil {
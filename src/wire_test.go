@@ -12,11 +12,15 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "octet", map[string]string{"blksize": "1428", "tsize": "0"}},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -51,6 +55,26 @@ func TestSerializationDeserialization(t *testing.T) {
 	}
 }
 
+func TestDeserializationBadOptions(t *testing.T) {
+	// A malformed or unterminated option is dropped, the request and the options before it are kept
+	tests := map[string]map[string]string{
+		"\x00\x01foo\x00octet\x00tsize\x00":                    nil,
+		"\x00\x01foo\x00octet\x00tsize":                        nil,
+		"\x00\x01foo\x00octet\x00blksize\x001428\x00tsize\x00": {"blksize": "1428"},
+		"\x00\x02foo\x00octet\x00blksize\x001428\x00ts":        {"blksize": "1428"},
+	}
+	for raw, options := range tests {
+		_, p, err := ParsePacket([]byte(raw))
+		if err != nil {
+			t.Errorf("Parsing packet %q: unexpected error %s", raw, err)
+			continue
+		}
+		if request := p.(*PacketRequest); request.Filename != "foo" || request.Mode != "octet" || !reflect.DeepEqual(request.Options, options) {
+			t.Errorf("Parsing packet %q: expected options %v; got %#v", raw, options, request)
+		}
+	}
+}
+
 func TestDeserializationInvalid(t *testing.T) {
 	tests := [][]byte{
 		// no opcode
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Write policies, what a WRQ does when the file is already there
+const (
+	PolicyAllow     = "allow"            // overwrite it
+	PolicyDeny      = "deny-overwrite"   // refuse with ErrorFileExists
+	PolicyVersioned = "create-versioned" // keep it, save the upload as file.1, file.2, ...
+	PolicyTimestamp = "timestamp-suffix" // keep it, save the upload as file.20060102T150405Z
+)
+
+// timestampSuffix is the UTC time layout of PolicyTimestamp
+const timestampSuffix = "20060102T150405Z"
+
+// writePolicies picks where each WRQ is saved, it overwrites everywhere until configured
+var writePolicies = NewWritePolicies(PolicyAllow, nil)
+
+// WritePolicies is a default policy, and policies for directories (the closest one to a file wins)
+type WritePolicies struct {
+	mu       sync.Mutex
+	fallback string
+	dirs     map[string]string
+	reserved map[string]int // uploads in progress per target, so two WRQs don't pick the same name
+}
+
+// NewWritePolicies creates the struct
+func NewWritePolicies(fallback string, dirs map[string]string) *WritePolicies {
+	return &WritePolicies{
+		fallback: fallback,
+		dirs:     dirs,
+		reserved: make(map[string]int),
+	}
+}
+
+// SetPolicies replaces the default and per directory policies
+func (w *WritePolicies) SetPolicies(fallback string, dirs map[string]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fallback, w.dirs = fallback, dirs
+}
+
+// policy returns the policy that applies to target, a clean path
+func (w *WritePolicies) policy(target string) string {
+
+	policy, closest := w.fallback, ""
+	for dir, p := range w.dirs {
+		dir = filepath.Clean(dir)
+		if (dir == "." || strings.HasPrefix(target, dir+string(filepath.Separator))) && len(dir) >= len(closest) {
+			policy, closest = p, dir
+		}
+	}
+
+	return policy
+}
+
+// Reserve picks the file a WRQ for filename is saved to under its policy, and holds the name until Release,
+// an error means the upload must be refused with ErrorFileExists
+func (w *WritePolicies) Reserve(filename string) (string, error) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	target := filepath.Clean(filename)
+	taken := func(name string) bool { return w.reserved[name] > 0 || fileExists(name) }
+
+	switch w.policy(target) {
+	case PolicyDeny:
+		if taken(target) {
+			return "", fmt.Errorf("File already exists, overwrite denied")
+		}
+	case PolicyVersioned:
+		if taken(target) {
+			target = nextVersion(target, taken)
+		}
+	case PolicyTimestamp:
+		if taken(target) {
+			target = target + "." + time.Now().UTC().Format(timestampSuffix)
+			if taken(target) {
+				target = nextVersion(target, taken)
+			}
+		}
+	}
+
+	w.reserved[target]++
+	return target, nil
+}
+
+// Release gives up the name returned by Reserve, it stays held while other uploads (under allow) still use it
+func (w *WritePolicies) Release(target string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reserved[target]--; w.reserved[target] <= 0 {
+		delete(w.reserved, target)
+	}
+}
+
+// nextVersion is the first name.N (from 1) that isn't taken
+func nextVersion(name string, taken func(string) bool) string {
+	for n := 1; ; n++ {
+		version := name + "." + strconv.Itoa(n)
+		if !taken(version) {
+			return version
+		}
+	}
+}
+
+// ParseWritePolicy checks a policy name, as given to --overwrite
+func ParseWritePolicy(policy string) (string, error) {
+	switch policy {
+	case PolicyAllow, PolicyDeny, PolicyVersioned, PolicyTimestamp:
+		return policy, nil
+	}
+	return "", fmt.Errorf("ParseWritePolicy(): expected one of %s, %s, %s, %s; got:[%s]",
+		PolicyAllow, PolicyDeny, PolicyVersioned, PolicyTimestamp, policy)
+}
+
+// ParseDirPolicies parses "dir=policy" pairs, as given to --overwrite-dir
+func ParseDirPolicies(specs []string) (map[string]string, error) {
+
+	result := make(map[string]string)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("ParseDirPolicies(): expected dir=policy, got:[%s]", spec)
+		}
+		policy, err := ParseWritePolicy(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		result[spec[:i]] = policy
+	}
+
+	return result, nil
+}
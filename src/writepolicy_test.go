@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePolicies(t *testing.T) {
+	dir := t.TempDir()
+	dumps := filepath.Join(dir, "dumps")
+	stamped := filepath.Join(dir, "stamped")
+	locked := filepath.Join(dir, "locked")
+	for _, d := range []string{dumps, stamped, locked} {
+		os.Mkdir(d, 0755)
+		os.WriteFile(filepath.Join(d, "core"), []byte("first"), 0644)
+	}
+	os.WriteFile(filepath.Join(dir, "core"), []byte("first"), 0644)
+
+	nexus := NewFileNexus()
+	server := startServer(t, nexus)
+
+	t.Cleanup(func() { writePolicies.SetPolicies(PolicyAllow, nil) })
+	writePolicies.SetPolicies(PolicyDeny, map[string]string{
+		dumps:   PolicyVersioned,
+		stamped: PolicyTimestamp,
+		dir:     PolicyAllow,
+		locked:  PolicyDeny,
+	})
+
+	// The closest directory wins: dir allows, but locked (inside it) doesn't
+	if err := tftpPut(server, filepath.Join(dir, "core"), []byte("second")); err != nil {
+		t.Errorf("allow: %s", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "core")); string(data) != "second" {
+		t.Errorf("allow: expected file overwritten; got %q", data)
+	}
+
+	err := tftpPut(server, filepath.Join(locked, "core"), []byte("second"))
+	if err == nil || !strings.Contains(err.Error(), "code:[6]") {
+		t.Errorf("deny-overwrite: expected ErrorFileExists; got %v", err)
+	}
+	if err := tftpPut(server, filepath.Join(locked, "new"), []byte("second")); err != nil {
+		t.Errorf("deny-overwrite: new file refused: %s", err)
+	}
+
+	// Versions: the original stays, uploads go to core.1, core.2
+	for _, content := range []string{"second", "third"} {
+		if err := tftpPut(server, filepath.Join(dumps, "core"), []byte(content)); err != nil {
+			t.Fatalf("create-versioned: %s", err)
+		}
+	}
+	for name, content := range map[string]string{"core": "first", "core.1": "second", "core.2": "third"} {
+		if data, _ := os.ReadFile(filepath.Join(dumps, name)); string(data) != content {
+			t.Errorf("create-versioned: %s expected %q; got %q", name, content, data)
+		}
+	}
+
+	// Timestamps: the original stays, the upload lands next to it
+	if err := tftpPut(server, filepath.Join(stamped, "core"), []byte("second")); err != nil {
+		t.Fatalf("timestamp-suffix: %s", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(stamped, "core.*"))
+	if len(matches) != 1 {
+		t.Fatalf("timestamp-suffix: expected one new file; got %v", matches)
+	}
+	if data, _ := os.ReadFile(matches[0]); !bytes.Equal(data, []byte("second")) {
+		t.Errorf("timestamp-suffix: %s expected %q; got %q", matches[0], "second", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(stamped, "core")); string(data) != "first" {
+		t.Errorf("timestamp-suffix: original changed to %q", data)
+	}
+}
+
+func TestWritePoliciesShared(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "core")
+	w := NewWritePolicies(PolicyAllow, map[string]string{})
+
+	// Two uploads under allow share the name, it stays held until both release it
+	for i := 0; i < 2; i++ {
+		if name, err := w.Reserve(target); err != nil || name != target {
+			t.Fatalf("allow: expected %s; got %q, %v", target, name, err)
+		}
+	}
+	w.Release(target)
+
+	w.SetPolicies(PolicyDeny, nil)
+	if _, err := w.Reserve(target); err == nil {
+		t.Errorf("deny: expected the name still held after one release")
+	}
+	w.Release(target)
+	if _, err := w.Reserve(target); err != nil {
+		t.Errorf("deny: expected the name free after both releases; got %s", err)
+	}
+}